@@ -0,0 +1,101 @@
+// Copyright © 2016 Michael Kobaly mkobaly@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+
+	tc "github.com/mkobaly/devop/teamcity"
+)
+
+// artifactsCmd represents the artifacts command
+var artifactsCmd = &cobra.Command{
+	Use:   "artifacts buildId",
+	Short: "List or download the artifacts of a Teamcity build",
+	Long: `List or download the artifacts published by a Teamcity build. Downloads
+keep the directory structure of the artifacts and are checked against the
+size Teamcity reports. When the build also publishes a checksum file next to
+an artifact (ex app.zip.sha256, .sha1 or .md5) the download is verified
+against it.`,
+	Example: strings.Join([]string{
+		"- devop artifacts 5678                          List the artifacts of build 5678",
+		"- devop artifacts 5678 -o out                   Download all artifacts into out",
+		"- devop artifacts 5678 -o out -i '*.zip'        Only download zip files",
+	}, "\n"),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) == 0 {
+			return errors.New("A buildId must be specified")
+		}
+		buildID, err := strconv.ParseInt(args[0], 10, 64)
+		if err != nil {
+			return errors.New("Invalid buildId " + args[0])
+		}
+		out, _ := cmd.Flags().GetString("out")
+		include, _ := cmd.Flags().GetStringSlice("include")
+
+		ctx, cancel := commandContext()
+		defer cancel()
+
+		config := loadConfig()
+		t := tc.New(config.Teamcity).Track(tc.BuildInfo{}, buildID, "")
+
+		if out == "" {
+			artifacts, err := t.GetArtifacts(ctx)
+			if err != nil {
+				return err
+			}
+			for _, a := range artifacts {
+				if tc.MatchArtifact(a.Name, include) {
+					color.Green("%-60s %12d", a.Name, a.Size)
+				}
+			}
+			return nil
+		}
+		return downloadArtifacts(ctx, t, out, include)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(artifactsCmd)
+	artifactsCmd.Flags().StringP("out", "o", "", "Directory to download the artifacts to (list only if blank)")
+	addIncludeFlag(artifactsCmd)
+}
+
+//addIncludeFlag adds the flag used to filter which artifacts are downloaded
+func addIncludeFlag(cmd *cobra.Command) {
+	cmd.Flags().StringSliceP("include", "i", []string{}, "Only artifacts matching this glob, ex *.zip (repeatable)")
+}
+
+//downloadArtifacts downloads a build's artifacts and displays each one saved
+func downloadArtifacts(ctx context.Context, t *tc.Tracker, dir string, include []string) error {
+	downloads, err := t.DownloadArtifacts(ctx, dir, include)
+	for _, d := range downloads {
+		verified := "size only"
+		if d.Verified != "" {
+			verified = "verified " + d.Verified
+		}
+		color.Green("%s sha256:%s (%s)", d.Path, d.Checksum, verified)
+	}
+	if err == nil && len(downloads) == 0 {
+		color.Yellow("No artifacts to download for build %d", t.ID())
+	}
+	return err
+}
@@ -15,24 +15,167 @@
 package cmd
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"os"
+	"strings"
 
+	"github.com/fatih/color"
+	"github.com/mkobaly/devop/jira"
+	"github.com/mkobaly/devop/octopus"
+	"github.com/mkobaly/devop/state"
 	"github.com/spf13/cobra"
 )
 
+import tc "github.com/mkobaly/devop/teamcity"
+
 // assembleCmd represents the assemble command
 var assembleCmd = &cobra.Command{
 	Use:   "assemble",
-	Short: "Perform full automation description of your command",
-	Long: `A longer description that spans multiple lines and likely contains examples
-and usage of using your command. For example:
+	Short: "Build, release and optionally deploy a set of projects",
+	Long: `Runs the full pipeline for every project listed in a build file:
+
+  1. Kick off the Teamcity builds and wait for them to finish
+  2. Create an Octopus release for each project using the artifact version
+  3. Optionally create a Jira epic listing the releases
+  4. Optionally deploy the releases to an Octopus environment
+
+Each stage only starts once the previous one succeeded for every project.
+Progress is written to a state file (--state) as the run goes so an
+interrupted run can be picked up again with --resume. Builds and
+deployments still in flight are polled rather than started again and
+anything that failed is retried.
+
+The release version is read from the build artifact name by default
+(ex MyService.v1.2.3.zip). Other projects can be configured in the
+versions section of the config file, keyed by build configuration id or
+Octopus project name:
 
-Cobra is a CLI library for Go that empowers applications.
-This application is a tool to generate the needed files
-to quickly create a Cobra application.`,
+  versions:
+    default:
+      source: artifact
+      pattern: '^.+?\.(?P<version>\d+\.\d+\.\d+.*)\.nupkg$'
+    ServiceA_Release:
+      source: number
+    ServiceB:
+      source: property
+      property: build.version
+    ServiceC_Release:
+      source: tag`,
+	Example: strings.Join([]string{
+		"- devop assemble -f build.txt                               Build and create releases",
+		"- devop assemble -f build.txt -j OPS -s \"Release 1.2\"       Also create a Jira epic in project OPS",
+		"- devop assemble -f build.txt -d staging                    Also deploy the releases to staging",
+		"- devop assemble -f build.yaml                              Use a build manifest (see devop build --help)",
+		"- devop assemble --resume devop-state.json -d staging       Pick up an interrupted run where it left off",
+		"- devop assemble -f build.txt -d staging --dry-run          Show the builds, releases and deployments without making them",
+	}, "\n"),
 	RunE: func(cmd *cobra.Command, args []string) error {
-		// TODO: Work your own magic here
-		fmt.Println("assemble called")
+		buildFile, _ := cmd.Flags().GetString("buildFile")
+		resume, _ := cmd.Flags().GetString("resume")
+		if buildFile == "" && resume == "" {
+			return errors.New("You must provide a build file or a state file to resume")
+		}
+		jiraProject, _ := cmd.Flags().GetString("jiraProject")
+		summary, _ := cmd.Flags().GetString("summary")
+		if jiraProject != "" && summary == "" {
+			return errors.New("A summary must be specified when creating a Jira epic")
+		}
+		logFile, _ := cmd.Flags().GetString("logFile")
+		if logFile != "" {
+			_ = os.Remove(logFile)
+		}
+
+		ctx, cancel := commandContext()
+		defer cancel()
+
+		config := loadConfig()
+		octo := octopus.New(config.Octopus.URL, config.Octopus.Webapikey)
+
+		versions, err := tc.NewVersionResolvers(config.Versions)
+		if err != nil {
+			return err
+		}
+
+		builder := tc.New(config.Teamcity)
+		run, items, err := loadPipeline(cmd, func() ([]tc.BuildInfo, error) {
+			return parseBuildFile(ctx, builder, buildFile)
+		})
+		if err != nil {
+			return err
+		}
+
+		//validate the environments up front so we don't find out after the builds
+		environment, _ := cmd.Flags().GetString("deploy")
+		envs, err := deployEnvironments(ctx, items, environment, octo)
+		if err != nil {
+			return err
+		}
+		if dryRun(cmd) {
+			if run.EpicKey != "" {
+				jiraProject = ""
+			}
+			steps, err := planAssembly(ctx, items, builder, jiraProject, envs, environment, octo)
+			if err != nil {
+				return err
+			}
+			return printPlan(cmd, steps)
+		}
+		comments := map[string]string{}
+		for name, env := range envs {
+			if err := enforcePolicy(ctx, cmd, config, env, run.EpicKey); err != nil {
+				return err
+			}
+			override, err := enforceCalendar(cmd, config, env)
+			if err != nil {
+				return err
+			}
+			if override != "" {
+				comments[name] = "Deployed during a freeze: " + override
+				run.FreezeOverride = override
+			}
+		}
+		if err := saveState(run); err != nil {
+			return err
+		}
+		defer func() {
+			reportAssembly(items, logFile)
+			if ctx.Err() != nil {
+				abortRun(cmd, config, run, items)
+			}
+		}()
+
+		if err := runBuilds(ctx, builder, newBuildReporter(cmd), run, items); err != nil {
+			return err
+		}
+
+		notes, _ := cmd.Flags().GetString("releaseNotes")
+		if err := assembleReleases(ctx, run, items, notes, versions, octo); err != nil {
+			return err
+		}
+
+		releaseItems := []jira.ReleaseItem{}
+		for _, it := range items {
+			releaseItems = append(releaseItems, jira.ReleaseItem{Project: it.Project, Version: it.Version})
+		}
+
+		if jiraProject != "" && run.EpicKey == "" {
+			jiraAPI := jira.New(config.Jira)
+			issue, err := jiraAPI.CreateEpic(ctx, jiraProject, summary, config.Octopus.URL, releaseItems)
+			if err != nil {
+				return err
+			}
+			color.Green("Created Jira epic %s", issue.Key)
+			run.EpicKey = issue.Key
+			if err := saveState(run); err != nil {
+				return err
+			}
+		}
+
+		if len(envs) > 0 {
+			return assembleDeploy(ctx, run, items, envs, environment, newDeployOptions(cmd), comments, octo)
+		}
 		return nil
 	},
 }
@@ -41,15 +184,193 @@ func init() {
 	RootCmd.AddCommand(assembleCmd)
 	assembleCmd.Flags().StringP("buildFile", "f", "", "Build file listing out each project and branch to build")
 	assembleCmd.Flags().StringP("logFile", "l", "", "Log build results to file")
+	assembleCmd.Flags().StringP("releaseNotes", "n", "", "Release notes for each Octopus release")
+	assembleCmd.Flags().StringP("jiraProject", "j", "", "Jira project to create the release epic in")
+	assembleCmd.Flags().StringP("summary", "s", "", "Summary of the Jira release epic")
+	assembleCmd.Flags().StringP("deploy", "d", "", "Environment to deploy the releases to")
+	addParamFlag(assembleCmd)
+	addTagFlag(assembleCmd)
+	addReportFlags(assembleCmd)
+	addStateFlags(assembleCmd)
+	addCancelFlag(assembleCmd)
+	addMaxParallelFlag(assembleCmd)
+	addDryRunFlags(assembleCmd)
+	addPolicyFlags(assembleCmd)
+}
+
+//assembleReleases creates an Octopus release for each successful build.
+//The version of each build is found with its configured resolver and kept
+//in the state file so a resumed run releases the same version
+func assembleReleases(ctx context.Context, run *state.Run, items []*pipelineItem, notes string, versions *tc.VersionResolvers, octo *octopus.Octo) error {
+	for _, it := range items {
+		if it.Completed(state.StageRelease) {
+			continue
+		}
+		if it.Version == "" {
+			version, err := it.Tracker.ResolveVersion(ctx, versions.For(it.BuildInfo(), it.Project))
+			if err != nil {
+				it.fail(state.StageRelease, err)
+				continue
+			}
+			it.Version = version
+			if err := saveState(run); err != nil {
+				return err
+			}
+		}
+
+		projectID, err := octo.GetProjectID(ctx, it.Project)
+		if octopus.IsNotFound(err) {
+			err = errors.New("project " + it.Project + " not found in Octopus")
+		}
+		if err != nil {
+			it.fail(state.StageRelease, err)
+			continue
+		}
+		releaseNotes := notes
+		if releaseNotes == "" {
+			releaseNotes = releaseNotesFor(it.BuildInfo())
+		}
+		if _, err := octo.CreateRelease(ctx, projectID, it.Version, releaseNotes); err != nil {
+			it.fail(state.StageRelease, err)
+			continue
+		}
+		it.set(state.StageRelease, state.Success, nil)
+		color.Green("Created release %s %s", it.Project, it.Version)
+	}
+	if err := saveState(run); err != nil {
+		return err
+	}
+	return stageError(state.StageRelease, items)
+}
+
+//deployEnvironments looks up the Octopus environment each item deploys
+//to. Items use the environment from the build file when one is given and
+//otherwise fall back to defaultEnv. Items with neither are not deployed
+func deployEnvironments(ctx context.Context, items []*pipelineItem, defaultEnv string, octo *octopus.Octo) (map[string]octopus.Environment, error) {
+	envs := map[string]octopus.Environment{}
+	for _, it := range items {
+		name := targetEnvironment(it, defaultEnv)
+		if _, ok := envs[name]; ok || name == "" {
+			continue
+		}
+		env, err := validateEnvironment(ctx, name, octo)
+		if err != nil {
+			return nil, err
+		}
+		envs[name] = env
+	}
+	return envs, nil
+}
+
+//targetEnvironment returns the name of the environment an item deploys to
+func targetEnvironment(it *pipelineItem, defaultEnv string) string {
+	if it.Environment != "" {
+		return it.Environment
+	}
+	return defaultEnv
+}
 
-	// Here you will define your flags and configuration settings.
+//assembleDeploy deploys the releases to their environments and waits for
+//every deployment to finish. Deployments left running by a resumed run
+//are watched first. comments are added to the deployments of each
+//environment, ex why it was deployed to during a freeze
+func assembleDeploy(ctx context.Context, run *state.Run, items []*pipelineItem, envs map[string]octopus.Environment, defaultEnv string, opts deployOptions, comments map[string]string, octo *octopus.Octo) error {
+	byTask := map[string]*pipelineItem{}
+	watching := []octopus.TaskID{}
+	pending := map[string][]*pipelineItem{}
+	names := []string{}
+	for _, it := range items {
+		if it.Completed(state.StageDeploy) {
+			continue
+		}
+		if it.InFlight(state.StageDeploy) && it.TaskID != "" {
+			byTask[it.TaskID] = it
+			watching = append(watching, octopus.TaskID{TaskID: it.TaskID})
+			continue
+		}
+		if name := targetEnvironment(it, defaultEnv); name != "" {
+			if _, ok := pending[name]; !ok {
+				names = append(names, name)
+			}
+			pending[name] = append(pending[name], it)
+		}
+	}
 
-	// Cobra supports Persistent Flags which will work for this command
-	// and all subcommands, e.g.:
-	// assembleCmd.PersistentFlags().String("foo", "", "A help for foo")
+	var saveErr error
+	done := func(result octopus.TaskResult) {
+		reportTaskResult(result)
+		it := byTask[result.ID]
+		if it == nil {
+			return
+		}
+		if result.FinishedSuccessfully {
+			it.set(state.StageDeploy, state.Success, nil)
+		} else {
+			it.fail(state.StageDeploy, errors.New(result.ErrorMessage))
+		}
+		if err := saveState(run); err != nil {
+			saveErr = err
+		}
+	}
+	if _, err := watchTasks(ctx, watching, octo, done); err != nil {
+		return err
+	}
 
-	// Cobra supports local flags which will only run when this command
-	// is called directly, e.g.:
-	// assembleCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
+	for _, name := range names {
+		group := pending[name]
+		byRelease := map[jira.ReleaseItem]*pipelineItem{}
+		releaseItems := []jira.ReleaseItem{}
+		for _, it := range group {
+			r := jira.ReleaseItem{Project: it.Project, Version: it.Version}
+			byRelease[r] = it
+			releaseItems = append(releaseItems, r)
+		}
+		envOpts := opts
+		envOpts.comments = comments[name]
+		envOpts.started = func(r jira.ReleaseItem, task octopus.TaskID) {
+			it := byRelease[r]
+			it.TaskID = task.TaskID
+			it.set(state.StageDeploy, state.Running, nil)
+			byTask[task.TaskID] = it
+			if err := saveState(run); err != nil {
+				saveErr = err
+			}
+		}
+		envOpts.done = done
+		//failed deployments are recorded on their items so the other
+		//environments are still deployed
+		_, err := deployWaves(ctx, [][]jira.ReleaseItem{releaseItems}, envs[name], octo, envOpts)
+		if _, failed := err.(deployFailed); err != nil && !failed {
+			return err
+		}
+	}
+	if saveErr != nil {
+		return saveErr
+	}
+	return stageError(state.StageDeploy, items)
+}
+
+//releaseNotesFor returns the default release notes for a build
+func releaseNotesFor(bi tc.BuildInfo) string {
+	return fmt.Sprintf("Built by devop from %s using branch %s", bi.BuildConfigID, branchName(bi.Branch))
+}
 
+//reportAssembly prints a summary line for each project in the pipeline
+func reportAssembly(items []*pipelineItem, logFile string) {
+	color.Cyan("\n--------------------------------------------------------")
+	color.Cyan("Assembly Summary")
+	color.Cyan("--------------------------------------------------------")
+	for _, it := range items {
+		line := fmt.Sprintf("%-40s %-12s %-15s", it.BuildConfigID, it.BuildStatus, it.Version)
+		if it.Outcome == state.Failed {
+			line += fmt.Sprintf(" failed at %s: %s", it.Stage, it.Error)
+			color.Red("%s", line)
+		} else {
+			line += fmt.Sprintf(" %s %s", it.Stage, it.Outcome)
+			color.Green("%s", line)
+		}
+		if logFile != "" {
+			writeToLog(logFile, line)
+		}
+	}
 }
@@ -16,81 +16,107 @@ package cmd
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
+	"regexp"
 	"time"
 
 	"strings"
 
 	"github.com/fatih/color"
-	"github.com/mkobaly/devop/config"
 	"github.com/spf13/cobra"
-	"github.com/spf13/viper"
 )
 
 import tc "github.com/mkobaly/devop/teamcity"
-import teamcity "github.com/mkobaly/teamcity"
 
 // buildCmd represents the build command
 var buildCmd = &cobra.Command{
 	Use:   "build [buildId]",
 	Short: "Kick off a Teamcity build",
-	Long:  "This will start a Teamcity build of one or more projects",
+	Long: `This will start a Teamcity build of one or more projects.
+
+The build file is either plain text with one "buildId [branch]" per line or,
+when it ends in .yaml, .yml or .json, a versioned manifest:
+
+version: 1
+builds:
+  - id: SharedLib_Release
+  - id: ServiceA_Release
+    branch: develop
+    params:
+      env.VersionSuffix: beta
+    tags: [services]
+    project: ServiceA       # Octopus project when it differs from Teamcity
+    environment: staging    # where assemble deploys it
+    after: [SharedLib_Release]
+
+Every build in the file is checked against the Teamcity build configurations
+before anything is queued.`,
 	Example: strings.Join([]string{
 		"- devop build projectA                 Kick off build of projectA",
 		"- devop build projectA -b abc          Kick off build of projectA using branch abc",
 		"- devop build -f build.txt             Kick off build of all projects listed in build.txt",
+		"                                       (lines may end in after:buildA,buildB and --- starts a new stage)",
 		"- devop build projectA -l results.log  Kick off build of projectA and log build results to a file",
+		"- devop build projectA -P env.VersionSuffix=beta -P system.Toggle=on",
+		"                                       Kick off build of projectA overriding build parameters",
+		"- devop build --resume devop-state.json Resume polling builds from an interrupted run",
+		"- devop build -f build.txt --dry-run   Show what would be built without queuing anything",
+		"- devop build -f build.yaml --tag services",
+		"                                       Kick off only the builds in build.yaml tagged services",
 	}, "\n"),
 	RunE: func(cmd *cobra.Command, args []string) error {
 
-		config := config.NewConfig(viper.ConfigFileUsed())
-		tcb := tc.New(config.Teamcity)
-		//tcb := tc.Builder{Credentials: config.Teamcity}
+		ctx, cancel := commandContext()
+		defer cancel()
+
+		config := loadConfig()
 		logFile, _ := cmd.Flags().GetString("logFile")
 
 		if logFile != "" {
 			_ = os.Remove(logFile)
 		}
 
-		buildInfo := []tc.BuildInfo{}
-
-		if len(args) == 0 {
-			buildFile, _ := cmd.Flags().GetString("buildFile")
-			if buildFile == "" {
-				return errors.New("You must provide a buildId or set the buildFile flag")
-			}
-			builds, err := tc.ParseBuildFile(buildFile)
-			if err != nil {
-				return err
+		builder := tc.New(config.Teamcity)
+		run, items, err := loadPipeline(cmd, func() ([]tc.BuildInfo, error) {
+			if len(args) == 0 {
+				buildFile, _ := cmd.Flags().GetString("buildFile")
+				if buildFile == "" {
+					return nil, errors.New("You must provide a buildId or set the buildFile flag")
+				}
+				return parseBuildFile(ctx, builder, buildFile)
 			}
-			for _, b := range builds {
-				buildInfo = append(buildInfo, b)
-				//tcBuild(&tcb, b.BuildID, b.Branch, logFile)
-			}
-
-		} else { //single build
+			//single build
 			branch, _ := cmd.Flags().GetString("branch")
-			buildID := args[0]
-			buildInfo = append(buildInfo, tc.BuildInfo{BuildConfigID: buildID, Branch: branch})
-			//tcBuild(&tcb, buildID, branch, logFile)
+			return []tc.BuildInfo{{BuildConfigID: args[0], Branch: branch}}, nil
+		})
+		if err != nil {
+			return err
 		}
-
-		buildChan := make(chan teamcity.Build)
-		for _, bi := range buildInfo {
-			tcb.SetBuildInfo(bi)
-			if err := tcb.Build(); err != nil {
-				return err
+		if dryRun(cmd) {
+			if len(args) > 0 {
+				if err := builder.ValidateBuildTypes(ctx, []tc.BuildInfo{items[0].BuildInfo()}); err != nil {
+					return err
+				}
 			}
-			//tcBuild(&tcb, &bi, logFile)
-			go watchForFinishedBuild(tcb, buildChan)
+			return printPlan(cmd, planBuilds(items))
 		}
 
-		for i := 0; i < len(buildInfo); i++ {
-			reportResult(<-buildChan)
+		err = runBuilds(ctx, builder, newBuildReporter(cmd), run, items)
+		if ctx.Err() != nil {
+			abortRun(cmd, config, run, items)
 		}
-		return nil
+		if logFile != "" {
+			for _, it := range items {
+				if it.Tracker != nil {
+					writeToLog(logFile, it.Tracker.BuildResultToJson())
+				}
+			}
+		}
+		return err
 	},
 }
 
@@ -99,30 +125,147 @@ func init() {
 	buildCmd.Flags().StringP("branch", "b", "", "Branch to build (Default branch used if blank)")
 	buildCmd.Flags().StringP("buildFile", "f", "", "Build file listing out each project and branch to build")
 	buildCmd.Flags().StringP("logFile", "l", "", "Log build results to file")
+	addParamFlag(buildCmd)
+	addTagFlag(buildCmd)
+	addReportFlags(buildCmd)
+	addStateFlags(buildCmd)
+	addCancelFlag(buildCmd)
+	addDryRunFlags(buildCmd)
 
 	//buildCmd.Flags().StringP("projectId", "p", "", "Project to build")
 }
 
-func watchForFinishedBuild(b *tc.Builder, c chan teamcity.Build) error {
+//watchForFinishedBuild polls Teamcity for all of the builds at once until
+//at least one of them finishes and returns the trackers that finished.
+//Temporary polling failures are retried until too many happen in a row; it
+//returns early on any other error or if ctx is cancelled
+func watchForFinishedBuild(ctx context.Context, b *tc.Builder, trackers []*tc.Tracker) ([]*tc.Tracker, error) {
+	failures := 0
 	for {
-		time.Sleep(time.Second * 2)
-		err := b.VerifyBuildStatus()
-		if err != nil {
-			return err
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(time.Second * 2):
+		}
+		if err := b.Poll(ctx, trackers); err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			//a blip while polling shouldn't lose track of every build
+			if !tc.IsTemporary(err) {
+				return nil, err
+			}
+			failures++
+			if failures >= b.MaxPollFailures {
+				return nil, tc.PollError{Failures: failures, Err: err}
+			}
+			color.Yellow("\nUnable to poll Teamcity (%d/%d): %s", failures, b.MaxPollFailures, err)
+			continue
 		}
+		failures = 0
 		fmt.Print(".")
-		if b.BuildResult.State == "finished" {
-			c <- *b.BuildResult
-			return nil
+		finished := []*tc.Tracker{}
+		for _, t := range trackers {
+			if t.Finished() {
+				finished = append(finished, t)
+			}
+		}
+		if len(finished) > 0 {
+			return finished, nil
 		}
 	}
 }
 
-func reportResult(b teamcity.Build) {
-	if b.Status == "SUCCESS" {
-		color.Green("\n%s %s: %s ", b.BuildTypeID, b.State, b.Status)
-	} else {
-		color.Red("\n%s %s: %s", b.BuildTypeID, b.State, b.Status)
+//buildReporter displays the result of each finished build along with
+//the details of why it failed, copying everything to the log file if set
+type buildReporter struct {
+	logLines int
+	logFile  string
+	download string
+	include  []string
+}
+
+//addReportFlags adds the flags used to control how build results are reported
+func addReportFlags(cmd *cobra.Command) {
+	cmd.Flags().Int("log-lines", 20, "Lines from the end of the build log to show for failed builds (0 to skip)")
+	cmd.Flags().String("download", "", "Download the artifacts of each successful build to a sub directory per build and branch of this directory")
+	addIncludeFlag(cmd)
+}
+
+//newBuildReporter creates a reporter from the command's flags
+func newBuildReporter(cmd *cobra.Command) *buildReporter {
+	logLines, _ := cmd.Flags().GetInt("log-lines")
+	logFile, _ := cmd.Flags().GetString("logFile")
+	download, _ := cmd.Flags().GetString("download")
+	include, _ := cmd.Flags().GetStringSlice("include")
+	return &buildReporter{logLines: logLines, logFile: logFile, download: download, include: include}
+}
+
+//downloadArtifacts downloads the artifacts of a successful build into a
+//directory named after its build configuration and branch when --download
+//is set
+func (r *buildReporter) downloadArtifacts(ctx context.Context, t *tc.Tracker) error {
+	if r.download == "" {
+		return nil
+	}
+	return downloadArtifacts(ctx, t, filepath.Join(r.download, artifactDir(t.BuildInfo)), r.include)
+}
+
+//unsafePath matches what can't be used in a directory name
+var unsafePath = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+//artifactDir names the directory a build's artifacts are downloaded to.
+//The branch is only added when one was given so each branch of a build
+//configuration gets its own directory, ex ServiceA_Release_feature-login
+func artifactDir(bi tc.BuildInfo) string {
+	if bi.Branch == "" {
+		return bi.BuildConfigID
+	}
+	return bi.BuildConfigID + "_" + unsafePath.ReplaceAllString(bi.Branch, "-")
+}
+
+func (r *buildReporter) reportResult(ctx context.Context, t *tc.Tracker) {
+	b := t.Build
+	line := fmt.Sprintf("%s %s: %s", t.BuildInfo.BuildConfigID, b.State, b.Status)
+	if t.Succeeded() {
+		color.Green("\n%s", line)
+		r.log(line)
+		return
+	}
+	color.Red("\n%s", line)
+	r.log(line)
+
+	f, err := t.GetFailure(ctx, r.logLines)
+	if err != nil {
+		r.detail(color.RedString, "Unable to get failure details: "+err.Error())
+		return
+	}
+	r.section("Problems", f.Problems)
+	r.section("Failed tests", f.FailedTests)
+	r.section(fmt.Sprintf("Last %d lines of build log", len(f.LogTail)), f.LogTail)
+}
+
+//section displays a titled list of failure details
+func (r *buildReporter) section(title string, lines []string) {
+	if len(lines) == 0 {
+		return
+	}
+	r.detail(color.YellowString, "  "+title+":")
+	for _, l := range lines {
+		r.detail(fmt.Sprintf, "    "+l)
+	}
+}
+
+//detail displays a single line of failure details
+func (r *buildReporter) detail(format func(string, ...interface{}) string, line string) {
+	fmt.Println(format("%s", line))
+	r.log(line)
+}
+
+//log writes a line to the log file if one was given
+func (r *buildReporter) log(line string) {
+	if r.logFile != "" {
+		writeToLog(r.logFile, line)
 	}
 }
 
@@ -148,7 +291,7 @@ func reportResult(b teamcity.Build) {
 // }
 
 func writeToLog(path string, content string) {
-	fileHandle, _ := os.OpenFile(path, os.O_APPEND|os.O_CREATE, 0666)
+	fileHandle, _ := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
 	writer := bufio.NewWriter(fileHandle)
 	defer fileHandle.Close()
 	fmt.Fprintln(writer, content)
@@ -0,0 +1,133 @@
+// Copyright © 2016 Michael Kobaly mkobaly@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/mkobaly/devop/config"
+	"github.com/mkobaly/devop/octopus"
+	"github.com/mkobaly/devop/state"
+	"github.com/spf13/cobra"
+
+	tc "github.com/mkobaly/devop/teamcity"
+)
+
+// cancelCmd represents the cancel command
+var cancelCmd = &cobra.Command{
+	Use:   "cancel [taskId|buildId]",
+	Short: "Cancel Teamcity builds and Octopus deployments",
+	Long: `Cancel queued or running Teamcity builds and Octopus deployment tasks.
+Numeric ids are treated as Teamcity builds and anything else as an Octopus
+task. Given the state file of a build or assemble run, everything that run
+left in flight is cancelled.`,
+	Example: strings.Join([]string{
+		"- devop cancel ServerTasks-1234          Cancel an Octopus deployment",
+		"- devop cancel 5678                      Cancel a queued or running Teamcity build",
+		"- devop cancel -f devop-state.json       Cancel everything still in flight from a previous run",
+	}, "\n"),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		stateFile, _ := cmd.Flags().GetString("stateFile")
+		if len(args) == 0 && stateFile == "" {
+			return errors.New("A taskId, buildId or state file must be specified")
+		}
+
+		config := loadConfig()
+		octo := octopus.New(config.Octopus.URL, config.Octopus.Webapikey)
+
+		items := itemsFromArgs(args)
+		if stateFile != "" {
+			run, err := state.Load(stateFile)
+			if err != nil {
+				return err
+			}
+			for _, i := range run.Items {
+				if i.Outcome == state.Running {
+					items = append(items, i)
+				}
+			}
+			if len(items) == 0 {
+				color.Green("Nothing in flight for %s", stateFile)
+				return nil
+			}
+		}
+		return cancelItems(items, config, octo)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(cancelCmd)
+	cancelCmd.Flags().StringP("stateFile", "f", "", "State file of a previous build or assemble run")
+}
+
+//addCancelFlag adds the flag used to cancel everything in flight when a
+//run is interrupted or times out
+func addCancelFlag(cmd *cobra.Command) {
+	cmd.Flags().Bool("cancel-on-abort", false, "Cancel builds and deployments still in flight when interrupted")
+}
+
+//itemsFromArgs turns build and task ids into items. Numeric ids are
+//Teamcity builds and anything else is an Octopus task
+func itemsFromArgs(args []string) []*state.Item {
+	items := []*state.Item{}
+	for _, id := range args {
+		if buildID, err := strconv.ParseInt(id, 10, 64); err == nil {
+			items = append(items, &state.Item{BuildID: buildID})
+		} else {
+			items = append(items, &state.Item{TaskID: id})
+		}
+	}
+	return items
+}
+
+//cancelItems cancels the deployment or build of every item. A fresh
+//context is used since the one for the run has usually been cancelled
+//by the time this is called
+func cancelItems(items []*state.Item, config *config.Config, octo *octopus.Octo) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	failed := 0
+	for _, i := range items {
+		var err error
+		var what string
+		if i.TaskID != "" {
+			what = "deployment " + i.TaskID
+			err = octo.CancelTask(ctx, i.TaskID)
+		} else if i.BuildID != 0 {
+			what = "build " + strconv.FormatInt(i.BuildID, 10)
+			t := tc.New(config.Teamcity).Track(i.BuildInfo(), i.BuildID, i.BuildHREF)
+			err = t.Cancel(ctx, "Cancelled by devop")
+		} else {
+			continue
+		}
+		if err != nil {
+			failed++
+			color.Red("Unable to cancel %s %s: %s", i.BuildConfigID, what, err)
+		} else {
+			color.Yellow("Cancelled %s %s", i.BuildConfigID, what)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d item(s) could not be cancelled", failed, len(items))
+	}
+	return nil
+}
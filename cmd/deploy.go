@@ -16,7 +16,9 @@ package cmd
 
 import (
 	"bufio"
+	"context"
 	"errors"
+	"fmt"
 	"os"
 	"strings"
 	"time"
@@ -25,8 +27,9 @@ import (
 	"github.com/mkobaly/devop/config"
 	"github.com/mkobaly/devop/jira"
 	"github.com/mkobaly/devop/octopus"
+	"github.com/mkobaly/devop/policy"
+	"github.com/mkobaly/devop/state"
 	"github.com/spf13/cobra"
-	"github.com/spf13/viper"
 )
 
 // deployCmd represents the deploy command
@@ -42,6 +45,55 @@ Examples:
 devop deploy staging -p myProject
 devop deploy production -e abc-123
 devop deploy production -e abc-123 -l deploy.log
+devop deploy staging -d deploy.txt --max-parallel 3
+devop deploy staging -d deploy.txt --rollback-on-failure
+devop deploy staging -d deploy.txt --dry-run --format json
+devop deploy production -e abc-123 --confirm production
+
+Protected environments are listed in the policy section of the config
+file along with who may deploy to them and what else they require:
+
+  policy:
+    protected:
+      - name: production
+        groups: [release-managers]
+        users: [jsmith]
+        confirm: true
+        jiraStatus: Approved
+        changeWindows:
+          - days: [Tue, Thu]
+            start: "20:00"
+            end: "23:00"
+            timeZone: America/Chicago
+
+Without a policy section nobody may deploy to production.
+
+Freezes and change windows for any environment go in the calendar section.
+Policy change windows narrow these, a deploy has to fall in both. Deploying
+during a freeze or outside either set of windows needs --override-freeze
+with a reason, which is added to the Octopus deployments and the log file:
+
+  calendar:
+    default:
+      freezes:
+        - start: 2016-12-20
+          end: 2017-01-02
+          reason: Holiday code freeze
+    staging:
+      windows:
+        - days: [Mon, Tue, Wed, Thu, Fri]
+          start: "08:00"
+          end: "18:00"
+
+A deploy file lists a project and version on each line. A line of ---
+starts a new wave which is only deployed once every deployment in the
+wave before it finished successfully:
+
+  # the service bus has to be up before its consumers
+  ServiceBus 1.4.0
+  ---
+  OrderService 2.1.3
+  BillingService 0.9.12
 
 `,
 	RunE: func(cmd *cobra.Command, args []string) error {
@@ -49,16 +101,18 @@ devop deploy production -e abc-123 -l deploy.log
 			return errors.New("Environment not specified")
 		}
 
-		config := config.NewConfig(viper.ConfigFileUsed())
+		ctx, cancel := commandContext()
+		defer cancel()
+
+		config := loadConfig()
 		octo := octopus.New(config.Octopus.URL, config.Octopus.Webapikey)
 		jiraAPI := jira.New(config.Jira)
-		taskChan := make(chan octopus.TaskResult)
-		env, err := validateEnvironment(args[0], octo)
+		env, err := validateEnvironment(ctx, args[0], octo)
 		if err != nil {
 			return err
 		}
 
-		var releaseItems []jira.ReleaseItem
+		var waves [][]jira.ReleaseItem
 		epic, _ := cmd.Flags().GetString("epic")
 		project, _ := cmd.Flags().GetString("project")
 		deployFile, _ := cmd.Flags().GetString("deployFile")
@@ -72,27 +126,77 @@ devop deploy production -e abc-123 -l deploy.log
 			if version == "" {
 				return errors.New("Version must be specified when deploying indivdual project")
 			}
-			releaseItems = append(releaseItems, jira.ReleaseItem{Project: project, Version: version})
+			waves = append(waves, []jira.ReleaseItem{{Project: project, Version: version}})
 		} else if epic != "" {
-			releaseItems, err = jiraAPI.GetRelease(epic)
+			releaseItems, err := jiraAPI.GetRelease(ctx, epic)
 			if err != nil {
 				return err
 			}
+			waves = append(waves, releaseItems)
 		} else if deployFile != "" {
-			releaseItems, err = parseDeployFile(deployFile)
+			waves, err = parseDeployFile(deployFile)
+			if err != nil {
+				return err
+			}
 		}
 
-		tasks, err := deploy(releaseItems, env, octo)
+		if dryRun(cmd) {
+			steps, err := planDeploy(ctx, waves, env, octo)
+			if err != nil {
+				return err
+			}
+			return printPlan(cmd, steps)
+		}
+		if err := enforcePolicy(ctx, cmd, config, env, epic); err != nil {
+			return err
+		}
+		logFile, _ := cmd.Flags().GetString("logFile")
+		if logFile != "" {
+			_ = os.Remove(logFile)
+		}
+		override, err := enforceCalendar(cmd, config, env)
+		if err != nil {
+			return err
+		}
 
-		for _, task := range tasks {
-			//kick off goroutine to watch all projects getting deployed
-			go watchTaskForResult(task, octo, taskChan)
+		opts := newDeployOptions(cmd)
+		if override != "" {
+			opts.comments = "Deployed during a freeze: " + override
+		}
+		report := opts.done
+		opts.done = func(result octopus.TaskResult) {
+			report(result)
+			if logFile != "" {
+				writeToLog(logFile, taskResultLine(result))
+			}
+		}
+		var plan *rollbackPlan
+		if rollback, _ := cmd.Flags().GetBool("rollback-on-failure"); rollback {
+			if plan, err = newRollbackPlan(ctx, waves, env, octo); err != nil {
+				return err
+			}
+			opts.started = plan.started
 		}
 
-		for i := 0; i < len(tasks); i++ {
-			reportTaskResult(<-taskChan)
+		running, err := deployWaves(ctx, waves, env, octo, opts)
+		if plan != nil && ctx.Err() == nil && len(plan.deployed) > 0 && err != nil {
+			if rerr := plan.rollback(ctx, octo, opts); rerr != nil {
+				return fmt.Errorf("%s and rolling back failed: %s", err, rerr)
+			}
+			return fmt.Errorf("%s, rolled back to the previous releases", err)
 		}
-		return nil
+		if ctx.Err() != nil {
+			if cancelOnAbort, _ := cmd.Flags().GetBool("cancel-on-abort"); cancelOnAbort {
+				inFlight := []*state.Item{}
+				for _, t := range running {
+					inFlight = append(inFlight, &state.Item{TaskID: t.TaskID})
+				}
+				if cerr := cancelItems(inFlight, config, octo); cerr != nil {
+					color.Red("%s", cerr)
+				}
+			}
+		}
+		return err
 	},
 }
 
@@ -103,6 +207,11 @@ func init() {
 	deployCmd.Flags().StringP("project", "p", "", "Individual octopus project to deploy")
 	deployCmd.Flags().StringP("version", "v", "", "Version for individual project to deploy")
 	deployCmd.Flags().StringP("logFile", "l", "", "Log deployment results to file")
+	addMaxParallelFlag(deployCmd)
+	addDryRunFlags(deployCmd)
+	addPolicyFlags(deployCmd)
+	deployCmd.Flags().Bool("rollback-on-failure", false, "Redeploy the previous releases if any deployment fails")
+	addCancelFlag(deployCmd)
 
 	// Here you will define your flags and configuration settings.
 
@@ -117,91 +226,350 @@ func init() {
 }
 
 //validateEnvironment ensures the user passed in a valid Octopus
-//environment and that we are not deploying to production as that
-// is not allowed
-func validateEnvironment(env string, octo *octopus.Octo) (octopus.Environment, error) {
+//environment. Environment names are matched ignoring case
+func validateEnvironment(ctx context.Context, env string, octo *octopus.Octo) (octopus.Environment, error) {
 	var e octopus.Environment
-	if env == "production" {
-		return e, errors.New("Deploying to prodution is not allowed due to ISO requirements")
-	}
-	envs, err := octo.GetEnvironments()
+	envs, err := octo.GetEnvironments(ctx)
 	if err != nil {
-		panic(err.Error())
+		return e, err
 	}
 	envString := []string{}
 	for _, x := range envs {
-		if strings.ToLower(x.Name) == strings.ToLower(env) {
+		if strings.EqualFold(x.Name, env) {
 			return x, nil
 		}
-		if strings.ToLower(x.Name) != "production" {
-			envString = append(envString, x.Name)
-		}
+		envString = append(envString, x.Name)
 	}
 	return e, errors.New("Unknown environment " + env +
 		". Valid values are:\n\t" + strings.Join(envString, "\n\t"))
 }
 
+//enforcePolicy checks a deployment to env against the protected environment
+//policy in the config file. epic is the Jira epic being deployed, if any.
+//Environments that require it must be confirmed with --confirm or by
+//typing the environment name when asked
+func enforcePolicy(ctx context.Context, cmd *cobra.Command, config *config.Config, env octopus.Environment, epic string) error {
+	pe, ok := policy.Protected(config.Policy, env.Name)
+	if !ok {
+		return nil
+	}
+	jiraAPI := jira.New(config.Jira)
+	r := policy.Request{Environment: env.Name, Epic: epic, Now: time.Now()}
+	if policy.NeedsUser(pe) {
+		user, err := jiraAPI.Myself(ctx)
+		if err != nil {
+			return fmt.Errorf("Unable to look up who is deploying to %s: %s", env.Name, err)
+		}
+		r.User, r.Groups = user.Name, user.Groups
+	}
+	if pe.JiraStatus != "" && epic != "" {
+		status, err := jiraAPI.GetIssueStatus(ctx, epic)
+		if err != nil {
+			return fmt.Errorf("Unable to look up the status of epic %s: %s", epic, err)
+		}
+		r.EpicStatus = status
+	}
+	if err := policy.Check(pe, r); err != nil {
+		return err
+	}
+	if !pe.Confirm {
+		return nil
+	}
+
+	confirm, _ := cmd.Flags().GetString("confirm")
+	if confirm == "" {
+		color.Yellow("%s is a protected environment. Type its name to continue:", env.Name)
+		line, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		confirm = strings.TrimSpace(line)
+	}
+	if !strings.EqualFold(confirm, env.Name) {
+		return fmt.Errorf("Deploying to %s was not confirmed", env.Name)
+	}
+	return nil
+}
+
+//addPolicyFlags adds the flags used to satisfy the protected environment
+//policy and the deploy calendar
+func addPolicyFlags(cmd *cobra.Command) {
+	cmd.Flags().String("confirm", "", "Name of the protected environment being deployed to, instead of typing it when asked")
+	cmd.Flags().String("override-freeze", "", "Reason for deploying during a freeze or outside the calendar or policy change windows")
+}
+
+//addMaxParallelFlag adds the flag used to limit how many deployments run at once
+func addMaxParallelFlag(cmd *cobra.Command) {
+	cmd.Flags().Int("max-parallel", 0, "Most deployments to run at once (0 for no limit)")
+}
+
 //watchTaskForResult will poll Octopus for the result of a deployments
-//and once its completed will inform on resultChan
-func watchTaskForResult(t octopus.TaskID, o *octopus.Octo, resultChan chan octopus.TaskResult) {
+//and once its completed will inform on resultChan. Temporary errors are
+//retried but any other error is reported as a failed task. It gives up
+//without sending anything once ctx is cancelled
+func watchTaskForResult(ctx context.Context, t octopus.TaskID, o *octopus.Octo, resultChan chan octopus.TaskResult) {
 	//time.Sleep(time.Second * 5)
 	for {
-		result, err := o.GetTaskResult(t.TaskID)
-		if err == nil {
-			if result.IsCompleted {
-				resultChan <- result
-				return
+		result, err := o.GetTaskResult(ctx, t.TaskID)
+		if err == nil && result.IsCompleted {
+			resultChan <- result
+			return
+		}
+		if err != nil && ctx.Err() == nil && !octopus.IsTemporary(err) {
+			resultChan <- octopus.TaskResult{
+				ID:           t.TaskID,
+				Description:  t.TaskID,
+				State:        "Unknown",
+				IsCompleted:  true,
+				ErrorMessage: "Unable to check the task: " + err.Error(),
 			}
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second * 2):
 		}
-		time.Sleep(time.Second * 2)
 	}
 }
 
+//watchTasks waits for every task to finish, handing each result to done
+//as it comes in. If ctx is cancelled first the tasks still running are
+//listed and returned along with the context error
+func watchTasks(ctx context.Context, tasks []octopus.TaskID, o *octopus.Octo, done func(octopus.TaskResult)) ([]octopus.TaskID, error) {
+	taskChan := make(chan octopus.TaskResult, len(tasks))
+	running := map[string]bool{}
+	for _, task := range tasks {
+		running[task.TaskID] = true
+		//kick off goroutine to watch all projects getting deployed
+		go watchTaskForResult(ctx, task, o, taskChan)
+	}
+
+	for i := 0; i < len(tasks); i++ {
+		select {
+		case result := <-taskChan:
+			delete(running, result.ID)
+			done(result)
+		case <-ctx.Done():
+			color.Yellow("\nThe following deployments are still in flight:")
+			inFlight := []octopus.TaskID{}
+			for id := range running {
+				color.Yellow("\t%s", id)
+				inFlight = append(inFlight, octopus.TaskID{TaskID: id})
+			}
+			return inFlight, ctx.Err()
+		}
+	}
+	return nil, nil
+}
+
 //reportTaskResult will display the results of a project
 //getting deployed color coded
 func reportTaskResult(t octopus.TaskResult) {
 	if t.FinishedSuccessfully {
-		color.Green("%s - %s. Duration:%s ", t.State, t.Description, t.Duration)
+		color.Green("%s", taskResultLine(t))
 	} else {
-		color.Red("%s - %s Error: %s", t.State, t.Description, t.ErrorMessage)
+		color.Red("%s", taskResultLine(t))
+	}
+}
+
+//taskResultLine describes the result of a deployment
+func taskResultLine(t octopus.TaskResult) string {
+	if t.FinishedSuccessfully {
+		return fmt.Sprintf("%s - %s. Duration:%s ", t.State, t.Description, t.Duration)
+	}
+	return fmt.Sprintf("%s - %s Error: %s", t.State, t.Description, t.ErrorMessage)
+}
+
+//enforceCalendar checks that env is open for deploys right now. When it
+//is frozen or outside its change windows the deploy only goes ahead with
+//an --override-freeze reason. The reason is written to the log file and
+//returned so it can be recorded with the deployments
+func enforceCalendar(cmd *cobra.Command, config *config.Config, env octopus.Environment) (string, error) {
+	err := policy.CheckDeployTime(config, env.Name, time.Now())
+	if err == nil {
+		return "", nil
+	}
+	override, _ := cmd.Flags().GetString("override-freeze")
+	if override == "" {
+		return "", fmt.Errorf("%s\nUse --override-freeze with a reason to deploy anyway", err)
+	}
+	color.Yellow("%s\nOverriding: %s", err, override)
+	if logFile, _ := cmd.Flags().GetString("logFile"); logFile != "" {
+		writeToLog(logFile, fmt.Sprintf("%s freeze overridden for %s: %s", time.Now().Format(time.RFC3339), env.Name, override))
+	}
+	return override, nil
+}
+
+//deployOptions control how releases are deployed. At most maxParallel
+//deployments run at once (0 for no limit) and comments are shown on each
+//Octopus deployment. started is called as each deployment is queued and
+//done as each one finishes
+type deployOptions struct {
+	maxParallel int
+	comments    string
+	started     func(jira.ReleaseItem, octopus.TaskID)
+	done        func(octopus.TaskResult)
+}
+
+//newDeployOptions reads the deploy options from the command line. Results
+//are reported as they come in and nothing else is done when one starts
+func newDeployOptions(cmd *cobra.Command) deployOptions {
+	maxParallel, _ := cmd.Flags().GetInt("max-parallel")
+	return deployOptions{
+		maxParallel: maxParallel,
+		started:     func(jira.ReleaseItem, octopus.TaskID) {},
+		done:        reportTaskResult,
+	}
+}
+
+//deployWaves deploys each wave of releases to env in turn, only starting a
+//wave once every deployment in the wave before it finished successfully.
+//Every release is resolved in Octopus before anything is deployed so a bad
+//project name or version aborts the whole deployment. An error is returned
+//if any deployment failed. If ctx is cancelled the deployments still
+//running are returned with the error
+func deployWaves(ctx context.Context, waves [][]jira.ReleaseItem, env octopus.Environment, octo *octopus.Octo, opts deployOptions) ([]octopus.TaskID, error) {
+	releaseIDs := make([][]string, len(waves))
+	failures := []string{}
+	for i, wave := range waves {
+		for _, r := range wave {
+			_, releaseID, err := resolveRelease(ctx, r, octo)
+			if err != nil {
+				failures = append(failures, fmt.Sprintf("%s %s: %s", r.Project, r.Version, err))
+				continue
+			}
+			releaseIDs[i] = append(releaseIDs[i], releaseID)
+		}
+	}
+	if len(failures) > 0 {
+		return nil, errors.New("Unable to resolve the following release(s), nothing was deployed:\n\t" +
+			strings.Join(failures, "\n\t"))
 	}
+
+	for i, wave := range waves {
+		if len(waves) > 1 {
+			color.Cyan("Deploying wave %d of %d", i+1, len(waves))
+		}
+		failed, running, err := deployWave(ctx, wave, releaseIDs[i], env, octo, opts)
+		if err != nil {
+			return running, err
+		}
+		if failed > 0 && i < len(waves)-1 {
+			return nil, deployFailed(fmt.Sprintf("%d deployment(s) in wave %d failed, the remaining %d wave(s) were not deployed",
+				failed, i+1, len(waves)-i-1))
+		}
+		if failed > 0 {
+			return nil, deployFailed(fmt.Sprintf("%d deployment(s) failed", failed))
+		}
+	}
+	return nil, nil
 }
 
-//deployEpic will deploy all releases to the specified environment
-func deploy(releaseItems []jira.ReleaseItem, env octopus.Environment, octo *octopus.Octo) ([]octopus.TaskID, error) {
-	tasks := []octopus.TaskID{}
-	//releaseItems, err := GetJiraRelease(epic, config)
-	// if err != nil {
-	// 	return tasks, err
-	// 	//color.Red(err.Error())
-	// }
+//deployFailed is returned by deployWaves when deployments ran but some of
+//them failed. Their results have already been reported
+type deployFailed string
 
-	for _, r := range releaseItems {
-		projectID, _ := octo.GetProjectID(r.Project)
-		releaseID, _ := octo.GetReleaseID(projectID, r.Version)
-		ID, _ := octo.Deploy(releaseID, env.ID) //test(releaseID)
-		color.Green("Deploying %s. TaskId: %s", r.Project, ID.TaskID)
-		tasks = append(tasks, ID)
+func (e deployFailed) Error() string {
+	return string(e)
+}
+
+//deployWave deploys a set of releases keeping at most opts.maxParallel of
+//them running at once and waits for all of them to finish. It returns how
+//many deployments failed. If a deployment can't be started no more are
+//started but the ones already running are still waited on
+func deployWave(ctx context.Context, wave []jira.ReleaseItem, releaseIDs []string, env octopus.Environment, octo *octopus.Octo, opts deployOptions) (int, []octopus.TaskID, error) {
+	results := make(chan octopus.TaskResult, len(wave))
+	running := map[string]bool{}
+	failed := 0
+	next := 0
+	var deployErr error
+	for {
+		for deployErr == nil && next < len(wave) && (opts.maxParallel <= 0 || len(running) < opts.maxParallel) {
+			r := wave[next]
+			ID, err := octo.Deploy(ctx, releaseIDs[next], env.ID, opts.comments)
+			if err == nil && ID.TaskID == "" {
+				err = errors.New("Octopus did not return a task")
+			}
+			if err != nil {
+				deployErr = fmt.Errorf("Unable to deploy %s %s: %s", r.Project, r.Version, err)
+				break
+			}
+			color.Green("Deploying %s. TaskId: %s", r.Project, ID.TaskID)
+			running[ID.TaskID] = true
+			opts.started(r, ID)
+			go watchTaskForResult(ctx, ID, octo, results)
+			next++
+		}
+		if len(running) == 0 {
+			return failed, nil, deployErr
+		}
+
+		select {
+		case result := <-results:
+			delete(running, result.ID)
+			if !result.FinishedSuccessfully {
+				failed++
+			}
+			opts.done(result)
+		case <-ctx.Done():
+			color.Yellow("\nThe following deployments are still in flight:")
+			inFlight := []octopus.TaskID{}
+			for id := range running {
+				color.Yellow("\t%s", id)
+				inFlight = append(inFlight, octopus.TaskID{TaskID: id})
+			}
+			return failed, inFlight, ctx.Err()
+		}
 	}
-	return tasks, nil
 }
 
-//Will parse a deploy file that lists out each project version that needs to be deployed
-func parseDeployFile(path string) ([]jira.ReleaseItem, error) {
+//parseDeployFile parses a deploy file that lists out each project and
+//version that needs to be deployed, separated by whitespace. Blank lines
+//and lines starting with # are ignored. A line of --- starts a new wave
+//that is only deployed once the wave before it deployed successfully
+//
+//	ServiceBus 1.4.0
+//	---
+//	OrderService 2.1.3
+//	BillingService 0.9.12
+func parseDeployFile(path string) ([][]jira.ReleaseItem, error) {
 	file, err := os.Open(path)
 	if err != nil {
 		return nil, err
 	}
 	defer file.Close()
 
-	var ri []jira.ReleaseItem
+	waves := [][]jira.ReleaseItem{}
+	var wave []jira.ReleaseItem
+	errs := []string{}
+	line := 0
 	scanner := bufio.NewScanner(file)
 	for scanner.Scan() {
-		parts := strings.Split(scanner.Text(), " ")
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		if text == "---" {
+			if len(wave) > 0 {
+				waves = append(waves, wave)
+				wave = nil
+			}
+			continue
+		}
+		parts := strings.Fields(text)
 		if len(parts) != 2 {
-			return nil, errors.New("you must specify project and version")
+			errs = append(errs, fmt.Sprintf("line %d: you must specify project and version", line))
+			continue
 		}
-		ri = append(ri, jira.ReleaseItem{Project: parts[0], Version: parts[1]})
+		wave = append(wave, jira.ReleaseItem{Project: parts[0], Version: parts[1]})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("Invalid deploy file %s:\n\t%s", path, strings.Join(errs, "\n\t"))
+	}
+	if len(wave) > 0 {
+		waves = append(waves, wave)
 	}
-	return ri, nil
+	return waves, nil
 }
@@ -0,0 +1,204 @@
+// Copyright © 2016 Michael Kobaly mkobaly@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/fatih/color"
+	"github.com/mkobaly/devop/octopus"
+	"github.com/spf13/cobra"
+)
+
+// driftCmd represents the drift command
+var driftCmd = &cobra.Command{
+	Use:   "drift",
+	Short: "Show the release of every project deployed to each environment",
+	Long: `Shows a matrix of the release version of each project deployed to each
+Octopus environment, read from the Octopus dashboard. Versions that differ
+from the first environment the project is deployed to are highlighted and
+environments a project was never deployed to are flagged as missing.`,
+	Example: strings.Join([]string{
+		"- devop drift                                   Show every project in every environment",
+		"- devop drift --env qa --env staging            Only compare qa and staging",
+		"- devop drift -p ServiceA --format csv          Show ServiceA as csv",
+	}, "\n"),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		envNames, _ := cmd.Flags().GetStringSlice("env")
+		projects, _ := cmd.Flags().GetStringSlice("project")
+		format, _ := cmd.Flags().GetString("format")
+
+		ctx, cancel := commandContext()
+		defer cancel()
+
+		config := loadConfig()
+		octo := octopus.New(config.Octopus.URL, config.Octopus.Webapikey)
+		envs := []octopus.Environment{}
+		for _, name := range envNames {
+			env, err := validateEnvironment(ctx, name, octo)
+			if err != nil {
+				return err
+			}
+			envs = append(envs, env)
+		}
+		dashboard, err := octo.GetDashboard(ctx)
+		if err != nil {
+			return err
+		}
+		if len(envs) == 0 {
+			envs = dashboard.Environments
+		}
+
+		report := newDriftReport(dashboard, envs, projects)
+		switch format {
+		case "table":
+			report.printTable()
+			return nil
+		case "json":
+			out, err := json.MarshalIndent(report, "", "\t")
+			if err != nil {
+				return err
+			}
+			fmt.Println(string(out))
+			return nil
+		case "csv":
+			return report.writeCSV()
+		}
+		return fmt.Errorf("Unknown format %s, expected table, json or csv", format)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(driftCmd)
+	driftCmd.Flags().StringSlice("env", []string{}, "Only show this environment (repeatable)")
+	driftCmd.Flags().StringSliceP("project", "p", []string{}, "Only show this project (repeatable)")
+	addFormatFlag(driftCmd, "table, json or csv")
+}
+
+//driftReport is the release of each project in each environment
+type driftReport struct {
+	Environments []string       `json:"environments"`
+	Projects     []projectDrift `json:"projects"`
+}
+
+//projectDrift is the release of a project in each environment. Versions
+//is keyed by environment name and has no entry where it is Missing
+type projectDrift struct {
+	Name     string            `json:"name"`
+	Versions map[string]string `json:"versions"`
+	Missing  []string          `json:"missing,omitempty"`
+	Drifted  bool              `json:"drifted"`
+}
+
+//newDriftReport builds the matrix for envs from the dashboard. Only the
+//named projects are included when any are given
+func newDriftReport(dashboard octopus.Dashboard, envs []octopus.Environment, projects []string) driftReport {
+	wanted := map[string]bool{}
+	for _, p := range projects {
+		wanted[strings.ToLower(p)] = true
+	}
+	report := driftReport{Environments: []string{}, Projects: []projectDrift{}}
+	for _, env := range envs {
+		report.Environments = append(report.Environments, env.Name)
+	}
+	for _, p := range dashboard.Projects {
+		if len(wanted) > 0 && !wanted[strings.ToLower(p.Name)] {
+			continue
+		}
+		pd := projectDrift{Name: p.Name, Versions: map[string]string{}}
+		for _, env := range envs {
+			item, ok := dashboard.DeployedRelease(p.ID, env.ID)
+			if !ok {
+				pd.Missing = append(pd.Missing, env.Name)
+				continue
+			}
+			pd.Versions[env.Name] = item.ReleaseVersion
+			if item.ReleaseVersion != pd.baseline(report.Environments) {
+				pd.Drifted = true
+			}
+		}
+		report.Projects = append(report.Projects, pd)
+	}
+	return report
+}
+
+//baseline returns the version in the first environment the project is
+//deployed to. Other environments are compared against it
+func (pd projectDrift) baseline(envs []string) string {
+	for _, env := range envs {
+		if v, ok := pd.Versions[env]; ok {
+			return v
+		}
+	}
+	return ""
+}
+
+//printTable prints the matrix with versions that differ from the baseline
+//in yellow and missing environments in red
+func (r driftReport) printTable() {
+	same := color.New(color.FgGreen).SprintFunc()
+	differ := color.New(color.FgYellow).SprintFunc()
+	missing := color.New(color.FgRed).SprintFunc()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "PROJECT\t%s\t\n", strings.Join(r.Environments, "\t"))
+	for _, p := range r.Projects {
+		cells := []string{}
+		baseline := p.baseline(r.Environments)
+		for _, env := range r.Environments {
+			v, ok := p.Versions[env]
+			switch {
+			case !ok:
+				cells = append(cells, missing("missing"))
+			case v != baseline:
+				cells = append(cells, differ(v))
+			default:
+				cells = append(cells, same(v))
+			}
+		}
+		name := p.Name
+		if p.Drifted || len(p.Missing) > 0 {
+			name = "* " + name
+		}
+		fmt.Fprintf(w, "%s\t%s\t\n", name, strings.Join(cells, "\t"))
+	}
+	w.Flush()
+}
+
+//writeCSV writes the matrix as csv with a blank cell where a project is
+//missing and a final column saying if the project drifted
+func (r driftReport) writeCSV() error {
+	w := csv.NewWriter(os.Stdout)
+	if err := w.Write(append(append([]string{"project"}, r.Environments...), "drifted", "missing")); err != nil {
+		return err
+	}
+	for _, p := range r.Projects {
+		row := []string{p.Name}
+		for _, env := range r.Environments {
+			row = append(row, p.Versions[env])
+		}
+		row = append(row, fmt.Sprint(p.Drifted), strings.Join(p.Missing, ";"))
+		if err := w.Write(row); err != nil {
+			return err
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
@@ -15,13 +15,13 @@
 package cmd
 
 import (
+	"context"
 	"strings"
 
 	"github.com/fatih/color"
 	"github.com/mkobaly/devop/config"
 	"github.com/mkobaly/devop/jira"
 	"github.com/spf13/cobra"
-	"github.com/spf13/viper"
 
 	tc "github.com/mkobaly/devop/teamcity"
 )
@@ -36,19 +36,22 @@ var listCmd = &cobra.Command{
 		"- devop list -e epicId        List projects that are part of Jira Epic",
 	}, "\n"),
 	RunE: func(cmd *cobra.Command, args []string) error {
-		config := config.NewConfig(viper.ConfigFileUsed())
+		ctx, cancel := commandContext()
+		defer cancel()
+
+		config := loadConfig()
 
 		epicID, _ := cmd.Flags().GetString("epicID")
 		if epicID == "" {
-			return getBuildTypes(config)
+			return getBuildTypes(ctx, config)
 		}
-		return epicDetails(cmd, config)
+		return epicDetails(ctx, cmd, config)
 	},
 }
 
-func getBuildTypes(config *config.Config) error {
+func getBuildTypes(ctx context.Context, config *config.Config) error {
 	tcb := tc.New(config.Teamcity)
-	builds, err := tcb.GetBuilds()
+	builds, err := tcb.GetBuilds(ctx)
 
 	if err == nil {
 		color.Cyan("--------------------------------------------------------")
@@ -62,12 +65,12 @@ func getBuildTypes(config *config.Config) error {
 	return err
 }
 
-func epicDetails(cmd *cobra.Command, config *config.Config) error {
+func epicDetails(ctx context.Context, cmd *cobra.Command, config *config.Config) error {
 	jiraAPI := jira.New(config.Jira)
 	epicID, _ := cmd.Flags().GetString("epicID")
 
 	if epicID != "" {
-		releases, err := jiraAPI.GetRelease(epicID)
+		releases, err := jiraAPI.GetRelease(ctx, epicID)
 		if err != nil {
 			return err
 		}
@@ -0,0 +1,394 @@
+// Copyright © 2016 Michael Kobaly mkobaly@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/fatih/color"
+	"github.com/mkobaly/devop/config"
+	"github.com/mkobaly/devop/octopus"
+	"github.com/mkobaly/devop/state"
+	"github.com/spf13/cobra"
+)
+
+import tc "github.com/mkobaly/devop/teamcity"
+import teamcity "github.com/mkobaly/teamcity"
+
+//pipelineItem tracks a single project as it moves through a build or
+//assemble run. The embedded state.Item is what gets written to the state file
+type pipelineItem struct {
+	*state.Item
+	Tracker *tc.Tracker
+	Err     error
+}
+
+//set records the outcome of a stage for the item
+func (p *pipelineItem) set(stage string, outcome string, err error) {
+	p.Err = err
+	p.Item.Set(stage, outcome, err)
+}
+
+//fail records the stage an item failed in
+func (p *pipelineItem) fail(stage string, err error) {
+	p.set(stage, state.Failed, err)
+}
+
+//addParamFlag adds the flag used to pass build parameters to every build
+func addParamFlag(cmd *cobra.Command) {
+	cmd.Flags().StringArrayP("param", "P", []string{}, "Build parameter name=value sent with every build, ex env.VersionSuffix=beta (repeatable, values may contain commas)")
+}
+
+//applyParams adds the --param build parameters to every build. Parameters
+//given on the command line win over ones from the build file
+func applyParams(cmd *cobra.Command, builds []tc.BuildInfo) error {
+	params, _ := cmd.Flags().GetStringArray("param")
+	for _, p := range params {
+		name, value, err := tc.ParseParam(p)
+		if err != nil {
+			return err
+		}
+		for i := range builds {
+			if builds[i].Params == nil {
+				builds[i].Params = map[string]string{}
+			}
+			builds[i].Params[name] = value
+		}
+	}
+	return nil
+}
+
+//addTagFlag adds the flag used to only run the builds with a given tag
+func addTagFlag(cmd *cobra.Command) {
+	cmd.Flags().StringSlice("tag", []string{}, "Only run builds from the build file with this tag (repeatable)")
+}
+
+//filterTags keeps the builds that have any of the --tag tags
+func filterTags(cmd *cobra.Command, builds []tc.BuildInfo) ([]tc.BuildInfo, error) {
+	tags, _ := cmd.Flags().GetStringSlice("tag")
+	if len(tags) == 0 {
+		return builds, nil
+	}
+	result := []tc.BuildInfo{}
+	for _, b := range builds {
+		if b.HasTag(tags) {
+			result = append(result, b)
+		}
+	}
+	if len(result) == 0 {
+		return nil, fmt.Errorf("No builds are tagged %s", strings.Join(tags, " or "))
+	}
+	return result, nil
+}
+
+//addStateFlags adds the flags used to persist and resume a run
+func addStateFlags(cmd *cobra.Command) {
+	cmd.Flags().String("state", "devop-state.json", "File the state of the run is written to, a run still in flight is never overwritten (blank to disable)")
+	cmd.Flags().String("resume", "", "Resume a previous run from its state file")
+}
+
+//loadPipeline creates the items for a run. When resuming, items come from
+//the state file and the run keeps writing to it. Otherwise they come from
+//the given builds and a fresh state file is started
+func loadPipeline(cmd *cobra.Command, builds func() ([]tc.BuildInfo, error)) (*state.Run, []*pipelineItem, error) {
+	resume, _ := cmd.Flags().GetString("resume")
+	var run *state.Run
+	if resume != "" {
+		r, err := state.Load(resume)
+		if err != nil {
+			return nil, nil, err
+		}
+		fmt.Fprintln(os.Stderr, color.GreenString("Resuming %s run started %s from %s", r.Command, r.Started.Format("2006-01-02 15:04:05"), resume))
+		run = r
+	} else {
+		bi, err := builds()
+		if err != nil {
+			return nil, nil, err
+		}
+		if bi, err = filterTags(cmd, bi); err != nil {
+			return nil, nil, err
+		}
+		if err := tc.ValidateDependencies(bi); err != nil {
+			return nil, nil, err
+		}
+		if err := applyParams(cmd, bi); err != nil {
+			return nil, nil, err
+		}
+		path, _ := cmd.Flags().GetString("state")
+		if err := checkStateFile(cmd, path); err != nil {
+			return nil, nil, err
+		}
+		run = state.New(path, cmd.Name())
+		for _, b := range bi {
+			run.Items = append(run.Items, &state.Item{
+				BuildConfigID: b.BuildConfigID,
+				Branch:        b.Branch,
+				After:         b.After,
+				Params:        b.Params,
+				Tags:          b.Tags,
+				Project:       b.Project,
+				Environment:   b.Environment,
+			})
+		}
+	}
+
+	items := []*pipelineItem{}
+	for _, i := range run.Items {
+		items = append(items, &pipelineItem{Item: i})
+	}
+	if dryRun(cmd) {
+		return run, items, nil
+	}
+	return run, items, saveState(run)
+}
+
+//checkStateFile refuses to start a new run over a state file whose run
+//still has builds or deployments in flight, they would be lost otherwise
+func checkStateFile(cmd *cobra.Command, path string) error {
+	if path == "" || dryRun(cmd) {
+		return nil
+	}
+	previous, err := state.Load(path)
+	if err != nil {
+		//missing or unreadable, there is nothing to resume
+		return nil
+	}
+	if n := previous.Running(); n > 0 {
+		return fmt.Errorf("%s holds a %s run started %s with %d build(s) or deployment(s) still in flight. "+
+			"Resume it with --resume %s or use --state to write this run somewhere else",
+			path, previous.Command, previous.Started.Format("2006-01-02 15:04:05"), n, path)
+	}
+	return nil
+}
+
+//parseBuildFile reads a build file and makes sure every build in it
+//exists on Teamcity
+func parseBuildFile(ctx context.Context, b *tc.Builder, path string) ([]tc.BuildInfo, error) {
+	builds, err := tc.ParseBuildFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return builds, b.ValidateBuildTypes(ctx, builds)
+}
+
+//saveState writes the run to its state file
+func saveState(run *state.Run) error {
+	if err := run.Save(); err != nil {
+		return fmt.Errorf("Unable to write state file %s: %s", run.Path(), err)
+	}
+	return nil
+}
+
+//runBuilds kicks off every build that has not been queued yet and waits
+//for all of them to finish. A build is only queued once every build it
+//depends on has succeeded and is skipped if any of them failed. Builds
+//already queued by a resumed run are only polled and builds that already
+//succeeded are skipped. Every build gets its own tracker but they are all
+//polled together
+func runBuilds(ctx context.Context, b *tc.Builder, r *buildReporter, run *state.Run, items []*pipelineItem) error {
+	builds := []tc.BuildInfo{}
+	for _, it := range items {
+		builds = append(builds, it.BuildInfo())
+	}
+	deps := map[*pipelineItem][]*pipelineItem{}
+	for i, it := range items {
+		for _, j := range tc.Dependencies(builds, i) {
+			deps[it] = append(deps[it], items[j])
+		}
+	}
+
+	byTracker := map[*tc.Tracker]*pipelineItem{}
+	watching := []*tc.Tracker{}
+	waiting := []*pipelineItem{}
+	for _, it := range items {
+		if it.Completed(state.StageBuild) {
+			it.Tracker = b.Track(it.BuildInfo(), it.BuildID, it.BuildHREF)
+			it.Tracker.Build = &teamcity.Build{ID: it.BuildID, BuildTypeID: it.BuildConfigID, State: "finished", Status: it.BuildStatus}
+			continue
+		}
+		if it.InFlight(state.StageBuild) && it.BuildID != 0 {
+			it.Tracker = b.Track(it.BuildInfo(), it.BuildID, it.BuildHREF)
+			byTracker[it.Tracker] = it
+			watching = append(watching, it.Tracker)
+			continue
+		}
+		//a build that failed last run is retried so its dependents must
+		//wait for it rather than be skipped
+		it.Outcome = ""
+		it.Error = ""
+		it.Err = nil
+		waiting = append(waiting, it)
+	}
+
+	for {
+		//queue everything whose dependencies are done
+		before := len(waiting)
+		stillWaiting := []*pipelineItem{}
+		for _, it := range waiting {
+			ready, err := dependenciesDone(deps[it])
+			if err != nil {
+				it.fail(state.StageBuild, err)
+				continue
+			}
+			if !ready {
+				stillWaiting = append(stillWaiting, it)
+				continue
+			}
+			t, err := b.Queue(ctx, it.BuildInfo())
+			if err != nil {
+				it.fail(state.StageBuild, err)
+				continue
+			}
+			it.Tracker = t
+			it.BuildID = t.Build.ID
+			it.BuildHREF = t.Build.HREF
+			it.BuildStatus = ""
+			it.set(state.StageBuild, state.Running, nil)
+			byTracker[t] = it
+			watching = append(watching, t)
+		}
+		waiting = stillWaiting
+		if err := saveState(run); err != nil {
+			return err
+		}
+		if len(watching) == 0 {
+			if len(waiting) > 0 && len(waiting) < before {
+				//a dependency failed this pass so check its dependents again
+				continue
+			}
+			for _, it := range waiting {
+				it.fail(state.StageBuild, errors.New("skipped, dependencies never finished"))
+			}
+			if err := saveState(run); err != nil {
+				return err
+			}
+			break
+		}
+
+		//builds still running are left that way in the state file so
+		//they can be resumed
+		finished, err := watchForFinishedBuild(ctx, b, watching)
+		if err != nil {
+			return err
+		}
+		for _, t := range finished {
+			it := byTracker[t]
+			r.reportResult(ctx, t)
+			it.BuildStatus = t.Build.Status
+			if t.Succeeded() {
+				if it.Project == "" {
+					it.Project = t.Build.BuildType.ProjectName
+				}
+				it.set(state.StageBuild, state.Success, nil)
+				//the build stays successful so a resumed run doesn't
+				//rebuild it but the run still fails
+				if err := r.downloadArtifacts(ctx, t); err != nil {
+					it.Err = fmt.Errorf("artifact download failed: %s", err)
+					it.Error = it.Err.Error()
+					color.Red("%s %s", it.BuildConfigID, it.Err)
+				}
+			} else {
+				it.fail(state.StageBuild, errors.New("build "+t.Build.Status))
+			}
+		}
+		watching = unfinished(watching)
+	}
+	return stageError(state.StageBuild, items)
+}
+
+//dependenciesDone returns true once every build an item depends on has
+//succeeded. An error is returned if any of them failed
+func dependenciesDone(deps []*pipelineItem) (bool, error) {
+	ready := true
+	for _, dep := range deps {
+		if dep.Completed(state.StageBuild) {
+			continue
+		}
+		if dep.Outcome == state.Failed {
+			return false, errors.New("skipped, " + dep.BuildConfigID + " " + branchName(dep.Branch) + " failed")
+		}
+		ready = false
+	}
+	return ready, nil
+}
+
+//unfinished returns the trackers whose builds have not finished yet
+func unfinished(trackers []*tc.Tracker) []*tc.Tracker {
+	result := []*tc.Tracker{}
+	for _, t := range trackers {
+		if !t.Finished() {
+			result = append(result, t)
+		}
+	}
+	return result
+}
+
+//reportInFlight lists everything a cancelled run left running and how to
+//pick it back up
+func reportInFlight(run *state.Run, items []*pipelineItem) {
+	color.Yellow("\nThe following are still in flight:")
+	for _, it := range items {
+		if it.Outcome != state.Running {
+			continue
+		}
+		switch it.Stage {
+		case state.StageBuild:
+			color.Yellow("\t%s build %d", it.BuildConfigID, it.BuildID)
+		case state.StageDeploy:
+			color.Yellow("\t%s deployment %s", it.Project, it.TaskID)
+		}
+	}
+	if run.Path() != "" {
+		color.Yellow("State saved to %s. Resume with --resume %s", run.Path(), run.Path())
+	}
+}
+
+//abortRun reports what a cancelled run left in flight and, when asked
+//to, cancels all of it
+func abortRun(cmd *cobra.Command, config *config.Config, run *state.Run, items []*pipelineItem) {
+	reportInFlight(run, items)
+	cancelOnAbort, _ := cmd.Flags().GetBool("cancel-on-abort")
+	if !cancelOnAbort {
+		return
+	}
+	inFlight := []*state.Item{}
+	for _, it := range items {
+		if it.Outcome == state.Running {
+			inFlight = append(inFlight, it.Item)
+		}
+	}
+	octo := octopus.New(config.Octopus.URL, config.Octopus.Webapikey)
+	if err := cancelItems(inFlight, config, octo); err != nil {
+		color.Red("%s", err)
+	}
+}
+
+//stageError returns an error if any item failed during the given stage
+func stageError(stage string, items []*pipelineItem) error {
+	failed := 0
+	for _, it := range items {
+		if it.Err != nil {
+			failed++
+		}
+	}
+	if failed == 0 {
+		return nil
+	}
+	return fmt.Errorf("%d of %d project(s) failed during %s stage", failed, len(items), stage)
+}
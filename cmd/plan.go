@@ -0,0 +1,306 @@
+// Copyright © 2016 Michael Kobaly mkobaly@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/fatih/color"
+	"github.com/mkobaly/devop/jira"
+	"github.com/mkobaly/devop/octopus"
+	"github.com/mkobaly/devop/state"
+	"github.com/spf13/cobra"
+
+	tc "github.com/mkobaly/devop/teamcity"
+)
+
+//Changes a plan step can make
+const (
+	planAdd       = "+"
+	planChange    = "~"
+	planUnchanged = "="
+	planProblem   = "!"
+)
+
+//planStep is one thing a command would do. Current is what is there now
+//and Target what it would be afterwards
+type planStep struct {
+	Change        string            `json:"change"`
+	Action        string            `json:"action"`
+	Name          string            `json:"name"`
+	ID            string            `json:"id,omitempty"`
+	Current       string            `json:"current,omitempty"`
+	CurrentID     string            `json:"currentId,omitempty"`
+	Target        string            `json:"target,omitempty"`
+	TargetID      string            `json:"targetId,omitempty"`
+	Environment   string            `json:"environment,omitempty"`
+	EnvironmentID string            `json:"environmentId,omitempty"`
+	Wave          int               `json:"wave,omitempty"`
+	After         []string          `json:"after,omitempty"`
+	Params        map[string]string `json:"params,omitempty"`
+	Error         string            `json:"error,omitempty"`
+}
+
+//addDryRunFlags adds the flags used to show a plan instead of doing anything
+func addDryRunFlags(cmd *cobra.Command) {
+	cmd.Flags().Bool("dry-run", false, "Show what would be done without queuing or deploying anything")
+	addFormatFlag(cmd, "table or json")
+}
+
+//addFormatFlag adds the flag used to pick how results are printed
+func addFormatFlag(cmd *cobra.Command, formats string) {
+	cmd.Flags().String("format", "table", "Output format, "+formats)
+}
+
+//dryRun returns true if the command should only show its plan
+func dryRun(cmd *cobra.Command) bool {
+	d, _ := cmd.Flags().GetBool("dry-run")
+	return d
+}
+
+//planBuilds lists the builds that would be queued. Builds a resumed run
+//already finished or queued are left as they are
+func planBuilds(items []*pipelineItem) []planStep {
+	steps := []planStep{}
+	for _, it := range items {
+		step := planStep{
+			Change: planAdd,
+			Action: "build",
+			Name:   it.BuildConfigID,
+			Target: branchName(it.Branch),
+			After:  it.After,
+			Params: it.Params,
+		}
+		switch {
+		case it.Completed(state.StageBuild):
+			step.Change = planUnchanged
+			step.ID = fmt.Sprint(it.BuildID)
+			step.Current = it.BuildStatus
+		case it.InFlight(state.StageBuild) && it.BuildID != 0:
+			step.Change = planUnchanged
+			step.ID = fmt.Sprint(it.BuildID)
+			step.Current = "running"
+		}
+		steps = append(steps, step)
+	}
+	return steps
+}
+
+//planDeploy lists what each release would change in env, comparing the
+//release that would be deployed with the one deployed there now
+func planDeploy(ctx context.Context, waves [][]jira.ReleaseItem, env octopus.Environment, octo *octopus.Octo) ([]planStep, error) {
+	dashboard, err := octo.GetDashboard(ctx)
+	if err != nil {
+		return nil, err
+	}
+	steps := []planStep{}
+	for i, wave := range waves {
+		for _, r := range wave {
+			step := planStep{
+				Action:        "deploy",
+				Name:          r.Project,
+				Target:        r.Version,
+				Environment:   env.Name,
+				EnvironmentID: env.ID,
+			}
+			if len(waves) > 1 {
+				step.Wave = i + 1
+			}
+			projectID, releaseID, err := resolveRelease(ctx, r, octo)
+			step.ID, step.TargetID = projectID, releaseID
+			if err != nil {
+				step.Change, step.Error = planProblem, err.Error()
+				steps = append(steps, step)
+				continue
+			}
+			planCurrent(&step, dashboard, projectID, env.ID)
+			if step.CurrentID == releaseID {
+				step.Change = planUnchanged
+			}
+			steps = append(steps, step)
+		}
+	}
+	return steps, nil
+}
+
+//planCurrent fills in the release of a project deployed to an environment
+//now. It is an addition when the project has never been deployed there
+func planCurrent(step *planStep, dashboard octopus.Dashboard, projectID string, environmentID string) {
+	step.Change = planAdd
+	if item, ok := dashboard.DeployedRelease(projectID, environmentID); ok {
+		step.Change = planChange
+		step.Current, step.CurrentID = item.ReleaseVersion, item.ReleaseID
+	}
+}
+
+//printPlan prints the steps as a table or json. Steps that could not be
+//resolved make the plan fail
+func printPlan(cmd *cobra.Command, steps []planStep) error {
+	format, _ := cmd.Flags().GetString("format")
+	switch format {
+	case "json":
+		out, err := json.MarshalIndent(steps, "", "\t")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(out))
+	case "table":
+		title := "Plan"
+		if dryRun(cmd) {
+			title = "Dry run, nothing will be queued or deployed"
+		}
+		printPlanTable(title, steps)
+	default:
+		return fmt.Errorf("Unknown format %s, expected table or json", format)
+	}
+
+	problems := 0
+	for _, s := range steps {
+		if s.Change == planProblem {
+			problems++
+		}
+	}
+	if problems > 0 {
+		return fmt.Errorf("%d problem(s) found, nothing would be done", problems)
+	}
+	return nil
+}
+
+//printPlanTable prints the steps as a diff style table
+func printPlanTable(title string, steps []planStep) {
+	color.Cyan("--------------------------------------------------------")
+	color.Cyan("%s", title)
+	color.Cyan("--------------------------------------------------------")
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "\tACTION\tNAME\tID\tCURRENT\tTARGET\tENVIRONMENT\tDETAIL")
+	for _, s := range steps {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			s.Change, s.Action, s.Name, s.ID,
+			withID(s.Current, s.CurrentID), withID(s.Target, s.TargetID),
+			withID(s.Environment, s.EnvironmentID), planDetail(s))
+	}
+	w.Flush()
+}
+
+//planDetail summarises the rest of a step for the table
+func planDetail(s planStep) string {
+	detail := []string{}
+	if s.Error != "" {
+		detail = append(detail, s.Error)
+	}
+	if s.Wave > 0 {
+		detail = append(detail, fmt.Sprintf("wave %d", s.Wave))
+	}
+	if len(s.After) > 0 {
+		detail = append(detail, "after "+strings.Join(s.After, ","))
+	}
+	names := []string{}
+	for name := range s.Params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		detail = append(detail, name+"="+s.Params[name])
+	}
+	return strings.Join(detail, " ")
+}
+
+//withID adds an Octopus id to a name when there is one
+func withID(name string, id string) string {
+	if id == "" {
+		return name
+	}
+	return name + " (" + id + ")"
+}
+
+//branchName returns the branch to display for a build
+func branchName(branch string) string {
+	if branch == "" {
+		return "[Default]"
+	}
+	return branch
+}
+
+//planAssembly lists the builds, releases, epic and deployments assemble
+//would make. Releases use the Octopus project of each build configuration
+//since there is no build to read it from yet
+func planAssembly(ctx context.Context, items []*pipelineItem, b *tc.Builder, jiraProject string, envs map[string]octopus.Environment, defaultEnv string, octo *octopus.Octo) ([]planStep, error) {
+	steps := planBuilds(items)
+
+	types, err := b.GetBuilds(ctx)
+	if err != nil {
+		return nil, err
+	}
+	projects := map[string]string{}
+	for _, t := range types {
+		projects[t.ID] = t.ProjectName
+	}
+	var dashboard octopus.Dashboard
+	if len(envs) > 0 {
+		if dashboard, err = octo.GetDashboard(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	version := func(it *pipelineItem) string {
+		if it.Version != "" {
+			return it.Version
+		}
+		return "(from build)"
+	}
+	deploys := []planStep{}
+	for _, it := range items {
+		project := it.Project
+		if project == "" {
+			project = projects[it.BuildConfigID]
+		}
+		step := planStep{Change: planAdd, Action: "release", Name: project, Target: version(it)}
+		projectID, err := octo.GetProjectID(ctx, project)
+		if octopus.IsNotFound(err) {
+			err = fmt.Errorf("project %s not found in Octopus", project)
+		}
+		if err != nil {
+			step.Change, step.Error = planProblem, err.Error()
+		}
+		step.ID = projectID
+		if it.Completed(state.StageRelease) {
+			step.Change = planUnchanged
+		}
+		steps = append(steps, step)
+
+		name := targetEnvironment(it, defaultEnv)
+		if name == "" || err != nil {
+			continue
+		}
+		env := envs[name]
+		deploy := planStep{Action: "deploy", Name: project, ID: projectID, Target: version(it),
+			Environment: env.Name, EnvironmentID: env.ID}
+		planCurrent(&deploy, dashboard, projectID, env.ID)
+		if it.Completed(state.StageDeploy) || (it.Version != "" && it.Version == deploy.Current) {
+			deploy.Change = planUnchanged
+		}
+		deploys = append(deploys, deploy)
+	}
+	if jiraProject != "" {
+		steps = append(steps, planStep{Change: planAdd, Action: "epic", Name: jiraProject})
+	}
+	return append(steps, deploys...), nil
+}
@@ -0,0 +1,162 @@
+// Copyright © 2016 Michael Kobaly mkobaly@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/fatih/color"
+	"github.com/mkobaly/devop/jira"
+	"github.com/mkobaly/devop/octopus"
+	"github.com/mkobaly/devop/state"
+	"github.com/spf13/cobra"
+)
+
+// promoteCmd represents the promote command
+var promoteCmd = &cobra.Command{
+	Use:   "promote",
+	Short: "Deploy the releases in one environment to another",
+	Long: `Looks up the release of each project currently deployed to the --from
+environment on the Octopus dashboard, shows how it differs from the --to
+environment and deploys every release that differs. Projects that were
+never deployed to --from are left alone.`,
+	Example: strings.Join([]string{
+		"- devop promote --from qa --to staging                  Promote everything in qa to staging",
+		"- devop promote --from qa --to staging -p ServiceA      Only promote ServiceA",
+		"- devop promote --from qa --to staging --dry-run        Only show what would be promoted",
+	}, "\n"),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		from, _ := cmd.Flags().GetString("from")
+		to, _ := cmd.Flags().GetString("to")
+		if from == "" || to == "" {
+			return errors.New("Both --from and --to environments must be specified")
+		}
+		projects, _ := cmd.Flags().GetStringSlice("project")
+
+		ctx, cancel := commandContext()
+		defer cancel()
+
+		config := loadConfig()
+		octo := octopus.New(config.Octopus.URL, config.Octopus.Webapikey)
+		source, err := validateEnvironment(ctx, from, octo)
+		if err != nil {
+			return err
+		}
+		target, err := validateEnvironment(ctx, to, octo)
+		if err != nil {
+			return err
+		}
+		dashboard, err := octo.GetDashboard(ctx)
+		if err != nil {
+			return err
+		}
+
+		steps, releases, releaseIDs := planPromotion(dashboard, source, target, projects)
+		if err := printPlan(cmd, steps); err != nil {
+			return err
+		}
+		if dryRun(cmd) {
+			return nil
+		}
+		if len(releases) == 0 {
+			color.Green("%s already has everything in %s", target.Name, source.Name)
+			return nil
+		}
+
+		if err := enforcePolicy(ctx, cmd, config, target, ""); err != nil {
+			return err
+		}
+		override, err := enforceCalendar(cmd, config, target)
+		if err != nil {
+			return err
+		}
+		opts := newDeployOptions(cmd)
+		opts.comments = "Promoted from " + source.Name
+		if override != "" {
+			opts.comments += ". Deployed during a freeze: " + override
+		}
+
+		failed, running, err := deployWave(ctx, releases, releaseIDs, target, octo, opts)
+		if ctx.Err() != nil {
+			if cancelOnAbort, _ := cmd.Flags().GetBool("cancel-on-abort"); cancelOnAbort {
+				inFlight := []*state.Item{}
+				for _, t := range running {
+					inFlight = append(inFlight, &state.Item{TaskID: t.TaskID})
+				}
+				if cerr := cancelItems(inFlight, config, octo); cerr != nil {
+					color.Red("%s", cerr)
+				}
+			}
+		}
+		if err == nil && failed > 0 {
+			err = fmt.Errorf("%d deployment(s) failed", failed)
+		}
+		return err
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(promoteCmd)
+	promoteCmd.Flags().String("from", "", "Environment to promote the releases from")
+	promoteCmd.Flags().String("to", "", "Environment to deploy the releases to")
+	promoteCmd.Flags().StringSliceP("project", "p", []string{}, "Only promote this project (repeatable)")
+	addMaxParallelFlag(promoteCmd)
+	addDryRunFlags(promoteCmd)
+	addPolicyFlags(promoteCmd)
+	addCancelFlag(promoteCmd)
+}
+
+//planPromotion compares the release of each project in source with the
+//one in target and returns the plan along with the releases that differ.
+//Only the named projects are compared when any are given
+func planPromotion(dashboard octopus.Dashboard, source octopus.Environment, target octopus.Environment, projects []string) ([]planStep, []jira.ReleaseItem, []string) {
+	wanted := map[string]bool{}
+	for _, p := range projects {
+		wanted[strings.ToLower(p)] = true
+	}
+	steps := []planStep{}
+	releases := []jira.ReleaseItem{}
+	releaseIDs := []string{}
+	for _, p := range dashboard.Projects {
+		if len(wanted) > 0 && !wanted[strings.ToLower(p.Name)] {
+			continue
+		}
+		delete(wanted, strings.ToLower(p.Name))
+		src, ok := dashboard.DeployedRelease(p.ID, source.ID)
+		if !ok {
+			if len(projects) > 0 {
+				steps = append(steps, planStep{Change: planProblem, Action: "deploy", Name: p.Name, ID: p.ID,
+					Environment: target.Name, EnvironmentID: target.ID, Error: "not deployed to " + source.Name})
+			}
+			continue
+		}
+		step := planStep{Action: "deploy", Name: p.Name, ID: p.ID, Target: src.ReleaseVersion, TargetID: src.ReleaseID,
+			Environment: target.Name, EnvironmentID: target.ID}
+		planCurrent(&step, dashboard, p.ID, target.ID)
+		if step.CurrentID == src.ReleaseID {
+			step.Change = planUnchanged
+		} else {
+			releases = append(releases, jira.ReleaseItem{Project: p.Name, Version: src.ReleaseVersion})
+			releaseIDs = append(releaseIDs, src.ReleaseID)
+		}
+		steps = append(steps, step)
+	}
+	for p := range wanted {
+		steps = append(steps, planStep{Change: planProblem, Action: "deploy", Name: p, Error: "project not found in Octopus"})
+	}
+	return steps, releases, releaseIDs
+}
@@ -0,0 +1,116 @@
+// Copyright © 2016 Michael Kobaly mkobaly@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/fatih/color"
+	"github.com/mkobaly/devop/jira"
+	"github.com/mkobaly/devop/octopus"
+)
+
+//rollbackPlan records the release of each project deployed to an
+//environment before a deployment starts so a failed deployment can be
+//put back the way it was
+type rollbackPlan struct {
+	env      octopus.Environment
+	previous map[string]octopus.DashboardItem
+	deployed []jira.ReleaseItem
+}
+
+//newRollbackPlan looks up the release of each project currently deployed
+//to env. Projects that were never deployed there have nothing to roll
+//back to
+func newRollbackPlan(ctx context.Context, waves [][]jira.ReleaseItem, env octopus.Environment, octo *octopus.Octo) (*rollbackPlan, error) {
+	dashboard, err := octo.GetDashboard(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to record the current releases in %s: %s", env.Name, err)
+	}
+	p := &rollbackPlan{env: env, previous: map[string]octopus.DashboardItem{}}
+	for _, wave := range waves {
+		for _, r := range wave {
+			projectID, err := octo.GetProjectID(ctx, r.Project)
+			if octopus.IsNotFound(err) {
+				err = errors.New("project not found")
+			}
+			if err != nil {
+				return nil, fmt.Errorf("Unable to record the current release of %s: %s", r.Project, err)
+			}
+			if item, ok := dashboard.DeployedRelease(projectID, env.ID); ok {
+				p.previous[r.Project] = item
+				color.Cyan("%s is currently at %s in %s", r.Project, item.ReleaseVersion, env.Name)
+			} else {
+				color.Yellow("%s has never been deployed to %s, it can't be rolled back", r.Project, env.Name)
+			}
+		}
+	}
+	return p, nil
+}
+
+//started records a release that was deployed
+func (p *rollbackPlan) started(r jira.ReleaseItem, task octopus.TaskID) {
+	p.deployed = append(p.deployed, r)
+}
+
+//rollback redeploys the previous release of every project that was
+//deployed, reporting the outcome of each one. Projects still on their
+//previous release or that have none are left alone
+func (p *rollbackPlan) rollback(ctx context.Context, octo *octopus.Octo, opts deployOptions) error {
+	color.Cyan("\n--------------------------------------------------------")
+	color.Cyan("Rolling back %s", p.env.Name)
+	color.Cyan("--------------------------------------------------------")
+
+	releases := []jira.ReleaseItem{}
+	releaseIDs := []string{}
+	for _, r := range p.deployed {
+		item, ok := p.previous[r.Project]
+		switch {
+		case !ok:
+			color.Yellow("SKIP %-40s no previous release", r.Project)
+		case item.ReleaseVersion == r.Version:
+			color.Yellow("SKIP %-40s already at %s", r.Project, r.Version)
+		default:
+			releases = append(releases, jira.ReleaseItem{Project: r.Project, Version: item.ReleaseVersion})
+			releaseIDs = append(releaseIDs, item.ReleaseID)
+		}
+	}
+	if len(releases) == 0 {
+		return nil
+	}
+
+	byTask := map[string]jira.ReleaseItem{}
+	opts.started = func(r jira.ReleaseItem, task octopus.TaskID) {
+		byTask[task.TaskID] = r
+	}
+	opts.done = func(result octopus.TaskResult) {
+		r := byTask[result.ID]
+		if result.FinishedSuccessfully {
+			color.Green("ROLLED BACK %-40s to %s", r.Project, r.Version)
+		} else {
+			color.Red("FAILED      %-40s to %s: %s", r.Project, r.Version, result.ErrorMessage)
+		}
+	}
+	failed, _, err := deployWave(ctx, releases, releaseIDs, p.env, octo, opts)
+	if err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d rollback(s) failed, %s needs attention", failed, p.env.Name)
+	}
+	return nil
+}
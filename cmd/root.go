@@ -15,15 +15,21 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"os/signal"
+	"time"
 
 	"github.com/fatih/color"
+	"github.com/mkobaly/devop/config"
+	"github.com/mkobaly/devop/transport"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
 
 var cfgFile string
+var timeout time.Duration
 
 // RootCmd represents the base command when called without any subcommands
 var RootCmd = &cobra.Command{
@@ -55,6 +61,7 @@ func init() {
 	// will be global for your application.
 
 	RootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.devop.yaml)")
+	RootCmd.PersistentFlags().DurationVar(&timeout, "timeout", 0, "Give up after this long, ex 30m (default is no timeout)")
 	// Cobra also supports local flags, which will only run
 	// when this action is called directly.
 	//RootCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
@@ -75,5 +82,40 @@ func initConfig() {
 		color.Red("Config file missing. Set --config flag to override default path. (Default is $HOME/.devop.yaml)")
 		os.Exit(-1)
 	}
-	color.Green("Using config file: %s\n", viper.ConfigFileUsed())
+	//stderr keeps stdout clean for --format json and csv
+	fmt.Fprintln(os.Stderr, color.GreenString("Using config file: %s", viper.ConfigFileUsed()))
+}
+
+//loadConfig reads the config file and sets up the http transport shared
+//by the Teamcity, Octopus and Jira clients from it
+func loadConfig() *config.Config {
+	c := config.NewConfig(viper.ConfigFileUsed())
+	transport.Configure(c.HTTP)
+	return c
+}
+
+//commandContext returns the context a command runs under. It is cancelled
+//once the --timeout elapses or the user hits Ctrl-C. A second Ctrl-C
+//kills the process as usual
+func commandContext() (context.Context, context.CancelFunc) {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), timeout)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+	go func() {
+		select {
+		case <-sig:
+			color.Yellow("\nInterrupted, stopping...")
+			cancel()
+		case <-ctx.Done():
+		}
+		signal.Stop(sig)
+	}()
+	return ctx, cancel
 }
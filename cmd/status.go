@@ -0,0 +1,191 @@
+// Copyright © 2016 Michael Kobaly mkobaly@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/mkobaly/devop/config"
+	"github.com/mkobaly/devop/octopus"
+	"github.com/mkobaly/devop/state"
+	"github.com/spf13/cobra"
+
+	tc "github.com/mkobaly/devop/teamcity"
+)
+
+// statusCmd represents the status command
+var statusCmd = &cobra.Command{
+	Use:   "status [taskId|buildId]",
+	Short: "Display the status of an Octopus task or Teamcity build",
+	Long: `Display the state, duration and error message of an Octopus task or
+Teamcity build. Numeric ids are treated as Teamcity builds and anything
+else as an Octopus task. A state file written by build or assemble can
+be given instead to see the status of every item in that run.`,
+	Example: strings.Join([]string{
+		"- devop status ServerTasks-1234          Status of an Octopus deployment",
+		"- devop status 5678                      Status of a Teamcity build",
+		"- devop status 5678 -w                   Poll until the build finishes",
+		"- devop status -f devop-state.json       Status of everything in a previous run",
+	}, "\n"),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		stateFile, _ := cmd.Flags().GetString("stateFile")
+		if len(args) == 0 && stateFile == "" {
+			return errors.New("A taskId, buildId or state file must be specified")
+		}
+		watch, _ := cmd.Flags().GetBool("watch")
+
+		ctx, cancel := commandContext()
+		defer cancel()
+
+		config := loadConfig()
+		octo := octopus.New(config.Octopus.URL, config.Octopus.Webapikey)
+
+		var items []*state.Item
+		if stateFile != "" {
+			run, err := state.Load(stateFile)
+			if err != nil {
+				return err
+			}
+			color.Cyan("%s run started %s", run.Command, run.Started.Format("2006-01-02 15:04:05"))
+			items = run.Items
+		}
+		items = append(items, itemsFromArgs(args)...)
+
+		first := true
+		for {
+			lines := []statusLine{}
+			done := true
+			for _, i := range items {
+				l := itemStatus(ctx, i, config, octo)
+				done = done && l.Done
+				lines = append(lines, l)
+			}
+			if first || done || !watch {
+				if !first {
+					fmt.Println()
+				}
+				reportStatus(lines)
+			}
+			if done || !watch {
+				return nil
+			}
+			first = false
+			fmt.Print(".")
+			select {
+			case <-ctx.Done():
+				fmt.Println()
+				return ctx.Err()
+			case <-time.After(time.Second * 2):
+			}
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(statusCmd)
+	statusCmd.Flags().StringP("stateFile", "f", "", "State file of a previous build or assemble run")
+	statusCmd.Flags().BoolP("watch", "w", false, "Poll until everything has finished")
+}
+
+//statusLine is the current status of a single build or task
+type statusLine struct {
+	ID       string
+	Name     string
+	State    string
+	Duration string
+	Message  string
+	Done     bool
+	Failed   bool
+}
+
+//itemStatus looks up the latest status of an item. Deployments take
+//precedence over builds since they come later in the pipeline
+func itemStatus(ctx context.Context, i *state.Item, config *config.Config, octo *octopus.Octo) statusLine {
+	if i.TaskID != "" {
+		return taskStatus(ctx, i.TaskID, octo)
+	}
+	if i.BuildID != 0 {
+		return buildStatus(ctx, i.BuildID, config)
+	}
+	l := statusLine{ID: "-", Name: i.BuildConfigID, State: "not started", Done: true}
+	if i.Outcome == state.Failed {
+		l.Message = i.Error
+		l.Failed = true
+	}
+	return l
+}
+
+//taskStatus returns the status of an Octopus task
+func taskStatus(ctx context.Context, taskID string, octo *octopus.Octo) statusLine {
+	l := statusLine{ID: taskID, Done: true}
+	t, err := octo.GetTaskResult(ctx, taskID)
+	if err != nil {
+		l.Failed = true
+		l.Message = err.Error()
+		return l
+	}
+	l.Name = t.Description
+	l.State = t.State
+	l.Duration = t.Duration
+	l.Message = t.ErrorMessage
+	l.Done = t.IsCompleted
+	l.Failed = t.IsCompleted && !t.FinishedSuccessfully
+	return l
+}
+
+//buildStatus returns the status of a Teamcity build
+func buildStatus(ctx context.Context, buildID int64, config *config.Config) statusLine {
+	l := statusLine{ID: strconv.FormatInt(buildID, 10), Done: true}
+	t := tc.New(config.Teamcity).Track(tc.BuildInfo{}, buildID, "")
+	if err := t.GetBuild(ctx); err != nil {
+		l.Failed = true
+		l.Message = err.Error()
+		return l
+	}
+	l.Name = t.Build.BuildTypeID
+	l.State = t.Build.State
+	if d := t.Duration(); d > 0 {
+		l.Duration = d.Round(time.Second).String()
+	}
+	l.Done = t.Finished()
+	if l.Done {
+		l.State += " " + t.Build.Status
+		l.Failed = !t.Succeeded()
+	}
+	if l.Failed {
+		l.Message = t.Build.StatusText
+	}
+	return l
+}
+
+//reportStatus displays each status line color coded
+func reportStatus(lines []statusLine) {
+	for _, l := range lines {
+		line := fmt.Sprintf("%-20s %-40s %-20s %-12s %s", l.ID, l.Name, l.State, l.Duration, l.Message)
+		if l.Failed {
+			color.Red("%s", line)
+		} else if !l.Done {
+			color.Yellow("%s", line)
+		} else {
+			color.Green("%s", line)
+		}
+	}
+}
@@ -15,51 +15,266 @@
 package cmd
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"strconv"
+	"strings"
 
 	"github.com/fatih/color"
-	"github.com/mkobaly/devop/config"
 	"github.com/mkobaly/devop/jira"
+	"github.com/mkobaly/devop/octopus"
 	"github.com/spf13/cobra"
-	"github.com/spf13/viper"
 )
 
 // verifyCmd represents the verify command
 var verifyCmd = &cobra.Command{
 	Use:   "verify",
-	Short: "Verify what projects are part of a release",
-	Long: `Verify what projects are part of a release. You can either do this
-against a Jira issue if you are using those to track your releases or against a release file
+	Short: "Verify the projects that are part of a release exist in Octopus",
+	Long: `Verify what projects are part of a release and that every project and
+release version exists in Octopus Deploy. You can either do this against a
+Jira issue if you are using those to track your releases or against a release
+file. The command exits with an error if anything is missing so it can be
+used to gate a deployment.
 
-Ex release file 
-TODO:
+With --env each release is also compared with the release of its project
+deployed to that environment and reported as up to date, behind, ahead or
+missing. Releases Octopus doesn't have still fail the command. Add
+--fail-on-drift to also exit with an error unless every release is up to
+date, ex as a release checklist.
 
+Ex release file (project version per line)
+
+myProject 1.2.3
+myOtherProject 2.0.1
 `,
+	Example: strings.Join([]string{
+		"- devop verify -e abc-123              Verify the releases in Jira epic abc-123",
+		"- devop verify -f release.txt          Verify the releases listed in release.txt",
+		"- devop verify -e abc-123 --env staging --fail-on-drift",
+		"                                       Fail unless staging has exactly the releases in abc-123",
+	}, "\n"),
 	RunE: func(cmd *cobra.Command, args []string) error {
-		config := config.NewConfig(viper.ConfigFileUsed())
+		ctx, cancel := commandContext()
+		defer cancel()
+
+		config := loadConfig()
 		jiraAPI := jira.New(config.Jira)
-		//tcb := build.TeamcityBuilder{Credentials: config.Teamcity}
+		octo := octopus.New(config.Octopus.URL, config.Octopus.Webapikey)
 		epicID, _ := cmd.Flags().GetString("epicID")
 		releaseFile, _ := cmd.Flags().GetString("releaseFile")
 
+		var releases []jira.ReleaseItem
+		var err error
 		if epicID != "" {
-			releases, err := jiraAPI.GetRelease(epicID)
+			releases, err = jiraAPI.GetRelease(ctx, epicID)
+		} else if releaseFile != "" {
+			var waves [][]jira.ReleaseItem
+			waves, err = parseDeployFile(releaseFile)
+			for _, wave := range waves {
+				releases = append(releases, wave...)
+			}
+		} else {
+			return errors.New("Either epicID or releaseFile are required")
+		}
+		if err != nil {
+			return err
+		}
+
+		envName, _ := cmd.Flags().GetString("env")
+		if envName != "" {
+			env, err := validateEnvironment(ctx, envName, octo)
 			if err != nil {
 				return err
 			}
-			color.Green("The following applications are part of this release")
-			color.Green("--------------------------------------------------------")
-			for _, r := range releases {
-				color.Green("%s - %s", r.Project, r.Version)
+			failOnDrift, _ := cmd.Flags().GetBool("fail-on-drift")
+			return verifyDeployed(ctx, releases, env, octo, failOnDrift)
+		}
+
+		color.Cyan("--------------------------------------------------------")
+		color.Cyan("The following applications are part of this release")
+		color.Cyan("--------------------------------------------------------")
+		failed := 0
+		for _, r := range releases {
+			if _, _, err := resolveRelease(ctx, r, octo); err != nil {
+				failed++
+				color.Red("FAIL %-40s %-15s %s", r.Project, r.Version, err)
+			} else {
+				color.Green("PASS %-40s %-15s", r.Project, r.Version)
 			}
 		}
+		if failed > 0 {
+			return fmt.Errorf("%d of %d release(s) could not be found in Octopus", failed, len(releases))
+		}
+		return nil
+	},
+}
 
-		if releaseFile != "" {
+//verifyDeployed compares each release with the release of its project
+//deployed to env. Each one is up to date, behind or ahead of the deployed
+//release, or missing when the project or release isn't in Octopus or was
+//never deployed to env. Releases Octopus doesn't have always fail so the
+//command can gate a deployment; anything else only fails with failOnDrift
+func verifyDeployed(ctx context.Context, releases []jira.ReleaseItem, env octopus.Environment, octo *octopus.Octo, failOnDrift bool) error {
+	dashboard, err := octo.GetDashboard(ctx)
+	if err != nil {
+		return err
+	}
 
+	color.Cyan("--------------------------------------------------------")
+	color.Cyan("The release compared with what is deployed to %s", env.Name)
+	color.Cyan("--------------------------------------------------------")
+	notFound, drifted := 0, 0
+	for _, r := range releases {
+		projectID, _, err := resolveRelease(ctx, r, octo)
+		if err == errProjectNotFound || err == errReleaseNotFound {
+			notFound++
+			color.Red("MISSING    %-40s %-15s %s", r.Project, r.Version, err)
+			continue
 		}
-		// TODO: Work your own magic here
-		return errors.New("Either epicID or releaseFile are required")
-	},
+		if err != nil {
+			return err
+		}
+		deployed, ok := dashboard.DeployedRelease(projectID, env.ID)
+		if !ok {
+			drifted++
+			color.Red("MISSING    %-40s %-15s never deployed to %s", r.Project, r.Version, env.Name)
+			continue
+		}
+		switch c := compareVersions(deployed.ReleaseVersion, r.Version); {
+		case c == 0:
+			color.Green("UP-TO-DATE %-40s %-15s", r.Project, r.Version)
+		case c < 0:
+			drifted++
+			color.Yellow("BEHIND     %-40s %-15s %s has %s", r.Project, r.Version, env.Name, deployed.ReleaseVersion)
+		default:
+			drifted++
+			color.Yellow("AHEAD      %-40s %-15s %s has %s", r.Project, r.Version, env.Name, deployed.ReleaseVersion)
+		}
+	}
+	if notFound > 0 {
+		return fmt.Errorf("%d of %d release(s) could not be found in Octopus", notFound, len(releases))
+	}
+	if failOnDrift && drifted > 0 {
+		return fmt.Errorf("%d of %d release(s) are not deployed to %s", drifted, len(releases), env.Name)
+	}
+	return nil
+}
+
+//compareVersions compares two release versions part by part, numerically
+//where both parts are numbers. A pre-release (1.2.3-beta) comes before the
+//release itself. It returns -1, 0 or 1 like strings.Compare
+func compareVersions(a string, b string) int {
+	if a == b {
+		return 0
+	}
+	aVersion, aPre := splitPrerelease(a)
+	bVersion, bPre := splitPrerelease(b)
+	aParts := strings.Split(aVersion, ".")
+	bParts := strings.Split(bVersion, ".")
+	for i := 0; i < len(aParts) || i < len(bParts); i++ {
+		x, y := "0", "0"
+		if i < len(aParts) {
+			x = aParts[i]
+		}
+		if i < len(bParts) {
+			y = bParts[i]
+		}
+		if c := comparePart(x, y); c != 0 {
+			return c
+		}
+	}
+	switch {
+	case aPre == bPre:
+		return 0
+	case aPre == "":
+		return 1
+	case bPre == "":
+		return -1
+	}
+	return comparePrerelease(aPre, bPre)
+}
+
+//splitPrerelease splits 1.2.3-beta.1 into 1.2.3 and beta.1. Build
+//metadata after a + is dropped since it doesn't change the version
+func splitPrerelease(v string) (string, string) {
+	if i := strings.Index(v, "+"); i >= 0 {
+		v = v[:i]
+	}
+	if i := strings.Index(v, "-"); i >= 0 {
+		return v[:i], v[i+1:]
+	}
+	return v, ""
+}
+
+//comparePrerelease compares two pre-release versions identifier by
+//identifier so beta.10 is after beta.9. Numeric identifiers come before
+//alphanumeric ones and a shorter pre-release comes first when the rest
+//match
+func comparePrerelease(a string, b string) int {
+	aIDs := strings.Split(a, ".")
+	bIDs := strings.Split(b, ".")
+	for i := 0; i < len(aIDs) && i < len(bIDs); i++ {
+		_, errA := strconv.ParseInt(aIDs[i], 10, 64)
+		_, errB := strconv.ParseInt(bIDs[i], 10, 64)
+		switch {
+		case errA == nil && errB != nil:
+			return -1
+		case errA != nil && errB == nil:
+			return 1
+		}
+		if c := comparePart(aIDs[i], bIDs[i]); c != 0 {
+			return c
+		}
+	}
+	switch {
+	case len(aIDs) < len(bIDs):
+		return -1
+	case len(aIDs) > len(bIDs):
+		return 1
+	}
+	return 0
+}
+
+//comparePart compares one part of a version, numerically when both are numbers
+func comparePart(a string, b string) int {
+	x, errA := strconv.ParseInt(a, 10, 64)
+	y, errB := strconv.ParseInt(b, 10, 64)
+	if errA == nil && errB == nil {
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+		return 0
+	}
+	return strings.Compare(a, b)
+}
+
+//errors returned by resolveRelease when Octopus doesn't know the release
+var (
+	errProjectNotFound = errors.New("project not found")
+	errReleaseNotFound = errors.New("release not found")
+)
+
+//resolveRelease looks up the Octopus project and release id for a release item
+func resolveRelease(ctx context.Context, r jira.ReleaseItem, octo *octopus.Octo) (string, string, error) {
+	projectID, err := octo.GetProjectID(ctx, r.Project)
+	if octopus.IsNotFound(err) {
+		return "", "", errProjectNotFound
+	}
+	if err != nil {
+		return "", "", err
+	}
+	releaseID, err := octo.GetReleaseID(ctx, projectID, r.Version)
+	if octopus.IsNotFound(err) {
+		return projectID, "", errReleaseNotFound
+	}
+	if err != nil {
+		return projectID, "", err
+	}
+	return projectID, releaseID, nil
 }
 
 func init() {
@@ -67,6 +282,8 @@ func init() {
 
 	verifyCmd.Flags().StringP("epicID", "e", "", "Verify Jira Epic (release) to see what packages are part of it")
 	verifyCmd.Flags().StringP("releaseFile", "f", "", "Release file to verify")
+	verifyCmd.Flags().String("env", "", "Compare the releases with what is deployed to this environment")
+	verifyCmd.Flags().Bool("fail-on-drift", false, "Exit with an error unless every release is deployed to --env")
 
 	// Here you will define your flags and configuration settings.
 
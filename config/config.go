@@ -2,6 +2,7 @@ package config
 
 import (
 	"io/ioutil"
+	"time"
 
 	yaml "gopkg.in/yaml.v2"
 )
@@ -12,6 +13,79 @@ type UserCredential struct {
 	Password string
 }
 
+//VersionConfig describes how the version of a finished build is found.
+//Source is one of artifact, number, property or tag. Pattern is a regular
+//expression that picks the version out of the value read from the source;
+//the "version" named group or else the first group is used. Property is
+//the build property read by the property source
+type VersionConfig struct {
+	Source   string
+	Pattern  string
+	Property string
+}
+
+//HTTPConfig controls how requests to Teamcity, Octopus and Jira are retried
+//and rate limited. Retries is how many times a failed GET is tried again,
+//waiting BaseDelay and doubling up to MaxDelay. RateLimit is the most
+//requests per second sent to any one host and Budget the most retries the
+//whole run may make. Blank values use the defaults and a negative Retries
+//or Budget turns retrying off
+type HTTPConfig struct {
+	Retries   int
+	BaseDelay time.Duration `yaml:"baseDelay"`
+	MaxDelay  time.Duration `yaml:"maxDelay"`
+	RateLimit float64       `yaml:"rateLimit"`
+	Budget    int
+}
+
+//ProtectedEnvironment is an environment that needs more than a valid
+//Octopus environment to deploy to. Only the listed Jira Users or members of
+//the listed Jira Groups may deploy to it; nobody may when both are empty.
+//Confirm asks for the environment name to be typed before deploying,
+//JiraStatus is the status the epic being deployed must be in and
+//ChangeWindows, when given, narrow the calendar: a deploy has to fall in
+//one of them as well as in the calendar's windows
+type ProtectedEnvironment struct {
+	Name          string
+	Users         []string
+	Groups        []string
+	Confirm       bool
+	JiraStatus    string         `yaml:"jiraStatus"`
+	ChangeWindows []ChangeWindow `yaml:"changeWindows"`
+}
+
+//ChangeWindow is a recurring time deploys are allowed in. Days are short
+//day names (Mon, Tue...), every day when empty. Start and End are 15:04
+//times in TimeZone, local time when blank
+type ChangeWindow struct {
+	Days     []string
+	Start    string
+	End      string
+	TimeZone string `yaml:"timeZone"`
+}
+
+//Freeze is a one off period nothing may be deployed, ex a code freeze.
+//Start and End are dates (2006-01-02, End included) or RFC3339 times
+type Freeze struct {
+	Start  string
+	End    string
+	Reason string
+}
+
+//Calendar is when an environment may be deployed to. Windows are the
+//recurring times deploys are allowed, any time when empty, and Freezes
+//the one off periods nothing may be deployed
+type Calendar struct {
+	Windows []ChangeWindow
+	Freezes []Freeze
+}
+
+//PolicyConfig lists the protected environments. Without a policy section
+//production is protected and nobody may deploy to it
+type PolicyConfig struct {
+	Protected []ProtectedEnvironment
+}
+
 type Config struct {
 	Jira    UserCredential
 	Octopus struct {
@@ -19,6 +93,15 @@ type Config struct {
 		Webapikey string
 	}
 	Teamcity UserCredential
+	//Versions maps a build configuration id or Octopus project name to how
+	//its version is found. The "default" entry applies to everything else
+	Versions map[string]VersionConfig
+	HTTP     HTTPConfig `yaml:"http"`
+	Policy   PolicyConfig
+	//Calendar maps an environment name to when it may be deployed to. The
+	//"default" freezes apply to every environment as do its windows unless
+	//the environment has windows of its own
+	Calendar map[string]Calendar
 }
 
 //NewConfig creates a new Configuration object needed
@@ -34,5 +117,8 @@ func NewConfig(configPath string) *Config {
 	if err != nil {
 		panic(err.Error())
 	}
+	if config.Policy.Protected == nil {
+		config.Policy.Protected = []ProtectedEnvironment{{Name: "production"}}
+	}
 	return config
 }
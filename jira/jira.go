@@ -3,6 +3,7 @@ package jira
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -12,6 +13,7 @@ import (
 	"strings"
 
 	"github.com/mkobaly/devop/config"
+	"github.com/mkobaly/devop/transport"
 )
 
 //ApiError represents a set of error(s) that the rest api threw
@@ -39,7 +41,7 @@ type IssueLink struct {
 type Issue struct {
 	BaseFields
 	Key    string      `json:"key"`
-	Fields IssueFields `json:fields"`
+	Fields IssueFields `json:"fields"`
 }
 
 type IssueFields struct {
@@ -99,17 +101,19 @@ type RestAPI struct {
 }
 
 // GetJiraRelease returns Epic information
-func (api *RestAPI) GetRelease(epicID string) ([]ReleaseItem, error) {
+func (api *RestAPI) GetRelease(ctx context.Context, epicID string) ([]ReleaseItem, error) {
 	results := []ReleaseItem{}
-	issue, err := api.getIssue(epicID)
+	issue, err := api.getIssue(ctx, epicID)
 	if err != nil {
 		return results, err
 	}
 
 	scanner := bufio.NewScanner(strings.NewReader(issue.Fields.Description.(string)))
 	for scanner.Scan() {
-		line := strings.ToLower(scanner.Text())
-		if strings.Contains(line, "/app#/projects") {
+		//only the link is matched case insensitively, the project and
+		//version keep their case so versions compare correctly
+		line := scanner.Text()
+		if strings.Contains(strings.ToLower(line), "/app#/projects") {
 			parts := strings.Split(line, "/")
 			results = append(results, ReleaseItem{Project: parts[5], Version: parts[7]})
 		}
@@ -117,22 +121,36 @@ func (api *RestAPI) GetRelease(epicID string) ([]ReleaseItem, error) {
 	return results, nil
 }
 
-func (api *RestAPI) CreateEpicNew(project string, summary string, projectItems []ProjectItem) (*Issue, error) {
+func (api *RestAPI) CreateEpicNew(ctx context.Context, project string, summary string, projectItems []ProjectItem) (*Issue, error) {
 	desc := convertToDescription(projectItems)
-	i := issue{summary: summary, description: desc, project: project1{key: project}, issuetype: issuetype{name: "epic"}}
+	i := issue{Fields: issueFields{Summary: summary, Description: desc, Project: project1{Key: project}, IssueType: issuetype{Name: "Epic"}}}
 	b, _ := json.Marshal(i)
-	issue, err := api.createIssue(bytes.NewReader(b))
+	issue, err := api.createIssue(ctx, bytes.NewReader(b))
 	return issue, err
 }
 
-//CreateEpic will create a new release epic in Jira
-func (api *RestAPI) CreateEpic(project string, summary string, releaseItems []ReleaseItem) (*Issue, error) {
-	i := issue{summary: summary, project: project1{key: project}, issuetype: issuetype{name: "epic"}}
+//CreateEpic will create a new release epic in Jira. Each release item is
+//written to the description as a link to its Octopus release so that
+//GetRelease can read the epic back
+func (api *RestAPI) CreateEpic(ctx context.Context, project string, summary string, octopusURL string, releaseItems []ReleaseItem) (*Issue, error) {
+	desc := releaseDescription(octopusURL, releaseItems)
+	i := issue{Fields: issueFields{Summary: summary, Description: desc, Project: project1{Key: project}, IssueType: issuetype{Name: "Epic"}}}
 	b, _ := json.Marshal(i)
-	issue, err := api.createIssue(bytes.NewReader(b))
+	issue, err := api.createIssue(ctx, bytes.NewReader(b))
 	return issue, err
 }
 
+//releaseDescription builds one Octopus release link per line in the
+//form {octopus}/app#/projects/{project}/releases/{version}
+func releaseDescription(octopusURL string, ri []ReleaseItem) string {
+	base := strings.TrimSuffix(strings.TrimRight(octopusURL, "/"), "/api")
+	desc := ""
+	for _, r := range ri {
+		desc += fmt.Sprintf("%s/app#/projects/%s/releases/%s\r\n", base, r.Project, r.Version)
+	}
+	return desc
+}
+
 func convertToDescription(pi []ProjectItem) string {
 	desc := "..."
 	for _, r := range pi {
@@ -141,32 +159,84 @@ func convertToDescription(pi []ProjectItem) string {
 	return desc
 }
 
-func (api *RestAPI) DeleteIssue(issue *Issue) error {
+func (api *RestAPI) DeleteIssue(ctx context.Context, issue *Issue) error {
 	url := fmt.Sprintf("%s/issue/%s", api.credentials.URL, issue.Key)
-	code, body := api.execRequest("DELETE", url, nil)
+	code, body, err := api.execRequest(ctx, "DELETE", url, nil)
+	if err != nil {
+		return err
+	}
 	if code != http.StatusNoContent {
 		return handleJiraError(body)
 	}
 	return nil
 }
 
-func (api *RestAPI) createIssue(params io.Reader) (*Issue, error) {
+func (api *RestAPI) createIssue(ctx context.Context, params io.Reader) (*Issue, error) {
 	url := fmt.Sprintf("%s/issue", api.credentials.URL)
-	code, body := api.execRequest("POST", url, params)
+	code, body, err := api.execRequest(ctx, "POST", url, params)
+	if err != nil {
+		return nil, err
+	}
 	if code == http.StatusCreated {
 		response := make(map[string]string)
 		err := json.Unmarshal(body, &response)
 		if err != nil {
 			return nil, err
 		}
-		return api.getIssue(response["key"])
+		return api.getIssue(ctx, response["key"])
 	}
 	return nil, handleJiraError(body)
 }
 
-func (api *RestAPI) getIssue(issueKey string) (*Issue, error) {
+//GetIssueStatus returns the name of the status an issue is in, ex Approved
+func (api *RestAPI) GetIssueStatus(ctx context.Context, issueKey string) (string, error) {
+	issue, err := api.getIssue(ctx, issueKey)
+	if err != nil {
+		return "", err
+	}
+	return issue.Fields.Status.Name, nil
+}
+
+//User is a Jira user and the names of the groups they belong to
+type User struct {
+	Name   string
+	Groups []string
+}
+
+//Myself returns the Jira user devop is logged in as
+func (api *RestAPI) Myself(ctx context.Context) (User, error) {
+	url := fmt.Sprintf("%s/myself?expand=groups", api.credentials.URL)
+	code, body, err := api.execRequest(ctx, "GET", url, nil)
+	if err != nil {
+		return User{}, err
+	}
+	if code != http.StatusOK {
+		return User{}, handleJiraError(body)
+	}
+	var result struct {
+		Name   string `json:"name"`
+		Groups struct {
+			Items []struct {
+				Name string `json:"name"`
+			} `json:"items"`
+		} `json:"groups"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return User{}, err
+	}
+	u := User{Name: result.Name}
+	for _, g := range result.Groups.Items {
+		u.Groups = append(u.Groups, g.Name)
+	}
+	return u, nil
+}
+
+func (api *RestAPI) getIssue(ctx context.Context, issueKey string) (*Issue, error) {
 	url := fmt.Sprintf("%s/issue/%s", api.credentials.URL, issueKey)
-	code, body := api.execRequest("GET", url, nil)
+	code, body, err := api.execRequest(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
 	if code == http.StatusOK {
 		var issue Issue
 		err := json.Unmarshal(body, &issue)
@@ -190,26 +260,24 @@ type ProjectItem struct {
 	Branch  string
 }
 
-func (api *RestAPI) execRequest(requestType, requestUrl string, data io.Reader) (int, []byte) {
-
-	client := &http.Client{}
+func (api *RestAPI) execRequest(ctx context.Context, requestType, requestUrl string, data io.Reader) (int, []byte, error) {
 	req, err := http.NewRequest(requestType, requestUrl, data)
 	if err != nil {
-		panic(err)
+		return 0, nil, err
 	}
 	req.Header.Add("Content-Type", "application/json")
 	req.SetBasicAuth(api.credentials.Username, api.credentials.Password)
-	resp, err := client.Do(req)
+	resp, err := transport.Client.Do(req.WithContext(ctx))
 	if err != nil {
-		panic(err)
+		return 0, nil, err
 	}
 	defer resp.Body.Close()
 
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		panic(err)
+		return 0, nil, err
 	}
-	return resp.StatusCode, body
+	return resp.StatusCode, body, nil
 }
 
 func handleJiraError(body []byte) error {
@@ -222,18 +290,22 @@ func handleJiraError(body []byte) error {
 }
 
 type project1 struct {
-	key string
+	Key string `json:"key"`
 }
 
 type issuetype struct {
-	name string
+	Name string `json:"name"`
+}
+
+type issueFields struct {
+	Summary     string    `json:"summary"`
+	Description string    `json:"description,omitempty"`
+	Project     project1  `json:"project"`
+	IssueType   issuetype `json:"issuetype"`
 }
 
 type issue struct {
-	summary     string
-	description string
-	project     project1
-	issuetype   issuetype
+	Fields issueFields `json:"fields"`
 }
 
 /*
@@ -0,0 +1,87 @@
+package octopus
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+//APIError is the error body returned by the Octopus REST API along with
+//the status code of the response
+type APIError struct {
+	StatusCode   int
+	ErrorMessage string
+	Errors       []string
+}
+
+func (e APIError) Error() string {
+	msg := e.ErrorMessage
+	if msg == "" {
+		msg = http.StatusText(e.StatusCode)
+	}
+	if len(e.Errors) > 0 {
+		msg += ": " + strings.Join(e.Errors, "; ")
+	}
+	return fmt.Sprintf("octopus %d: %s", e.StatusCode, msg)
+}
+
+//NotFoundError is returned when the requested resource does not exist
+type NotFoundError struct{ APIError }
+
+//UnauthorizedError is returned when the api key is missing, invalid or
+//lacks permission for the request
+type UnauthorizedError struct{ APIError }
+
+//ValidationError is returned when Octopus rejects the request. Errors
+//holds the details of what failed validation
+type ValidationError struct{ APIError }
+
+//ServerError is returned when Octopus fails to handle the request
+type ServerError struct{ APIError }
+
+//IsNotFound returns true if err is a NotFoundError
+func IsNotFound(err error) bool {
+	_, ok := err.(NotFoundError)
+	return ok
+}
+
+//IsTemporary returns true if err may go away when the request is tried
+//again, ie Octopus failed to handle the request or could not be reached
+func IsTemporary(err error) bool {
+	switch err.(type) {
+	case ServerError, *url.Error:
+		return true
+	}
+	return false
+}
+
+//IsUnauthorized returns true if err is an UnauthorizedError
+func IsUnauthorized(err error) bool {
+	_, ok := err.(UnauthorizedError)
+	return ok
+}
+
+//newAPIError reads the error details from a failed response and wraps them
+//in the error type matching the status code
+func newAPIError(resp *http.Response) error {
+	e := APIError{StatusCode: resp.StatusCode}
+	if body, err := ioutil.ReadAll(resp.Body); err == nil {
+		json.Unmarshal(body, &e)
+		e.StatusCode = resp.StatusCode
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return NotFoundError{e}
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return UnauthorizedError{e}
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return ServerError{e}
+	case resp.StatusCode >= 400:
+		return ValidationError{e}
+	}
+	return e
+}
@@ -2,8 +2,12 @@ package octopus
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"io"
 	"net/http"
+
+	"github.com/mkobaly/devop/transport"
 )
 
 // Internal json results returned from Octopus REST API
@@ -23,6 +27,7 @@ type result struct {
 type Octo struct {
 	url    string
 	apiKey string
+	client *http.Client
 }
 
 //TaskID represents a octopus task
@@ -42,6 +47,53 @@ type TaskResult struct {
 	ErrorMessage         string
 }
 
+//Release is a version of a project created in Octopus Deploy
+type Release struct {
+	ID        string
+	ProjectID string
+	Version   string
+}
+
+//DashboardItem is a release of a project deployed to an environment as
+//shown on the Octopus dashboard
+type DashboardItem struct {
+	ProjectID      string
+	EnvironmentID  string
+	ReleaseID      string
+	ReleaseVersion string
+	State          string
+	IsCurrent      bool
+}
+
+//Dashboard is the latest deployment of each project to each environment.
+//When the latest deployment failed the one before it is in PreviousItems
+type Dashboard struct {
+	Projects      []DashboardProject
+	Environments  []Environment
+	Items         []DashboardItem
+	PreviousItems []DashboardItem
+}
+
+//DashboardProject is a project shown on the dashboard
+type DashboardProject struct {
+	ID   string
+	Name string
+}
+
+//DeployedRelease returns the last release of a project that deployed
+//successfully to an environment. The bool is false when no release of the
+//project ever deployed successfully there
+func (d Dashboard) DeployedRelease(projectID string, environmentID string) (DashboardItem, bool) {
+	for _, items := range [][]DashboardItem{d.Items, d.PreviousItems} {
+		for _, item := range items {
+			if item.ProjectID == projectID && item.EnvironmentID == environmentID && item.State == "Success" {
+				return item, true
+			}
+		}
+	}
+	return DashboardItem{}, false
+}
+
 //Environment defined in Octopus Deploy
 type Environment struct {
 	ID   string
@@ -53,129 +105,71 @@ func New(url string, apiKey string) *Octo {
 	var octo = new(Octo)
 	octo.url = url
 	octo.apiKey = apiKey
+	octo.client = transport.Client
 	return octo
 }
 
 //GetEnvironments will return all of the environments defined in Octopus Deploy
-func (o *Octo) GetEnvironments() ([]Environment, error) {
-	url := o.url + "/environments"
-
-	client := &http.Client{}
-	req, _ := http.NewRequest("GET", url, nil)
-	req.Header.Set("X-Octopus-ApiKey", o.apiKey)
-	req.Header.Set("Content-Type", "application/json")
-
-	resp, err := client.Do(req)
-	defer resp.Body.Close()
-
-	if err != nil {
-		panic(err.Error())
-	}
-
+func (o *Octo) GetEnvironments(ctx context.Context) ([]Environment, error) {
 	var r result
-	er := decode(resp, &r)
-	return r.Items, er
+	err := o.do(ctx, "GET", "/environments", nil, &r)
+	return r.Items, err
 }
 
 //GetProjectID will return the projectId for a given project name
-func (o *Octo) GetProjectID(p string) (string, error) {
-	url := o.url + "/projects/" + p
-
-	client := &http.Client{}
-	req, _ := http.NewRequest("GET", url, nil)
-	req.Header.Set("X-Octopus-ApiKey", o.apiKey)
-	req.Header.Set("Content-Type", "application/json")
-
-	resp, err := client.Do(req)
-	defer resp.Body.Close()
-
-	if err != nil {
-		panic(err.Error())
-	}
-
+func (o *Octo) GetProjectID(ctx context.Context, p string) (string, error) {
 	var result id
-	er := decode(resp, &result)
-	return result.ID, er
+	err := o.do(ctx, "GET", "/projects/"+p, nil, &result)
+	return result.ID, err
 }
 
 //GetReleaseID returns a release id for a given projectId and release
 //projectId: projects-xxx
 //release: 3.3.4.0
-func (o *Octo) GetReleaseID(projectID string, release string) (string, error) {
-	url := o.url + "/projects/" + projectID + "/releases/" + release
-
-	client := &http.Client{}
-	req, _ := http.NewRequest("GET", url, nil)
-	req.Header.Set("X-Octopus-ApiKey", o.apiKey)
-	req.Header.Set("Content-Type", "application/json")
-
-	resp, err := client.Do(req)
-	defer resp.Body.Close()
-
-	if err != nil {
-		panic(err.Error())
-	}
+func (o *Octo) GetReleaseID(ctx context.Context, projectID string, release string) (string, error) {
 	var result id
-	er := decode(resp, &result)
+	err := o.do(ctx, "GET", "/projects/"+projectID+"/releases/"+release, nil, &result)
+	return result.ID, err
+}
 
-	return result.ID, er
+//GetDashboard returns the releases currently deployed to each environment
+func (o *Octo) GetDashboard(ctx context.Context) (Dashboard, error) {
+	var d Dashboard
+	err := o.do(ctx, "GET", "/dashboard", nil, &d)
+	return d, err
 }
 
 //GetTaskResult will return the status of a given task (deployment)
-func (o *Octo) GetTaskResult(taskID string) (TaskResult, error) {
-	url := o.url + "/tasks/" + taskID
-
-	client := &http.Client{}
-	req, _ := http.NewRequest("GET", url, nil)
-	req.Header.Set("X-Octopus-ApiKey", o.apiKey)
-	req.Header.Set("Content-Type", "application/json")
-
+func (o *Octo) GetTaskResult(ctx context.Context, taskID string) (TaskResult, error) {
 	var result TaskResult
-	resp, err := client.Do(req)
-	defer resp.Body.Close()
-
-	if err != nil {
-		return result, err
-	}
-
-	err = decode(resp, &result)
+	err := o.do(ctx, "GET", "/tasks/"+taskID, nil, &result)
 	return result, err
 }
 
-//Deploy a project specific release to the given environment
-func (o *Octo) Deploy(releaseID string, environmentID string) (TaskID, error) {
-	url := o.url + "/deployments/"
-
+//Deploy a project specific release to the given environment. comments
+//are shown on the deployment in Octopus
+func (o *Octo) Deploy(ctx context.Context, releaseID string, environmentID string, comments string) (TaskID, error) {
 	data := struct {
 		ReleaseID     string
 		EnvironmentID string
+		Comments      string `json:",omitempty"`
 	}{
 		releaseID,
 		environmentID,
-	}
-	b := new(bytes.Buffer)
-	json.NewEncoder(b).Encode(data)
-
-	client := &http.Client{}
-	req, _ := http.NewRequest("POST", url, b)
-	req.Header.Set("X-Octopus-ApiKey", o.apiKey)
-	req.Header.Set("Content-Type", "application/json")
-
-	resp, err := client.Do(req)
-	defer resp.Body.Close()
-
-	if err != nil {
-		panic(err.Error())
+		comments,
 	}
 	var result TaskID
-	er := decode(resp, &result)
+	err := o.do(ctx, "POST", "/deployments/", data, &result)
+	return result, err
+}
 
-	return result, er
+//CancelTask will cancel a running task (deployment)
+func (o *Octo) CancelTask(ctx context.Context, taskID string) error {
+	return o.do(ctx, "POST", "/tasks/"+taskID+"/cancel", nil, nil)
 }
 
 //CreateRelease will create a new release for a given project at the given version
-func (o *Octo) CreateRelease(projectID string, version string, releaseNotes string) error {
-	url := o.url + "/releases/"
+func (o *Octo) CreateRelease(ctx context.Context, projectID string, version string, releaseNotes string) (Release, error) {
 	data := struct {
 		ProjectID    string
 		Version      string
@@ -185,18 +179,45 @@ func (o *Octo) CreateRelease(projectID string, version string, releaseNotes stri
 		version,
 		releaseNotes,
 	}
-	b := new(bytes.Buffer)
-	json.NewEncoder(b).Encode(data)
+	var result Release
+	err := o.do(ctx, "POST", "/releases/", data, &result)
+	return result, err
+}
+
+//do sends a request to the Octopus REST API. The request is abandoned
+//when ctx is cancelled. body is sent as json when not
+//nil and a successful response is decoded into v when not nil. Any non
+//success status code is returned as one of the typed errors in errors.go
+func (o *Octo) do(ctx context.Context, method string, path string, body interface{}, v interface{}) error {
+	var r io.Reader
+	if body != nil {
+		b := new(bytes.Buffer)
+		if err := json.NewEncoder(b).Encode(body); err != nil {
+			return err
+		}
+		r = b
+	}
 
-	client := &http.Client{}
-	req, _ := http.NewRequest("POST", url, b)
+	req, err := http.NewRequest(method, o.url+path, r)
+	if err != nil {
+		return err
+	}
 	req.Header.Set("X-Octopus-ApiKey", o.apiKey)
 	req.Header.Set("Content-Type", "application/json")
 
-	resp, err := client.Do(req)
+	resp, err := o.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
 	defer resp.Body.Close()
-	return err
 
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return newAPIError(resp)
+	}
+	if v == nil {
+		return nil
+	}
+	return decode(resp, v)
 }
 
 func decode(r *http.Response, v interface{}) error {
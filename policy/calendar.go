@@ -0,0 +1,212 @@
+package policy
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mkobaly/devop/config"
+)
+
+//Closed is returned when an environment can't be deployed to right now,
+//either because of a freeze or because it is outside every change window
+type Closed struct {
+	Environment string
+	Reasons     []string
+}
+
+func (c Closed) Error() string {
+	return fmt.Sprintf("%s is closed for deploys:\n\t%s", c.Environment, strings.Join(c.Reasons, "\n\t"))
+}
+
+//CalendarFor returns the calendar of an environment. Freezes from the
+//"default" entry always apply and its windows do unless the environment
+//has its own
+func CalendarFor(c *config.Config, env string) config.Calendar {
+	var cal, fallback config.Calendar
+	for name, entry := range c.Calendar {
+		switch {
+		case name == "default":
+			fallback = entry
+		case strings.EqualFold(name, env):
+			cal.Windows = append(cal.Windows, entry.Windows...)
+			cal.Freezes = append(cal.Freezes, entry.Freezes...)
+		}
+	}
+	if len(cal.Windows) == 0 {
+		cal.Windows = append(cal.Windows, fallback.Windows...)
+	}
+	cal.Freezes = append(cal.Freezes, fallback.Freezes...)
+	return cal
+}
+
+//CheckDeployTime returns Closed if the calendar or the change windows of a
+//protected environment don't allow deploying to env now
+func CheckDeployTime(c *config.Config, env string, now time.Time) error {
+	reasons := []string{}
+	for _, err := range []error{CheckCalendar(CalendarFor(c, env), env, now), CheckChangeWindows(c.Policy, env, now)} {
+		if closed, ok := err.(Closed); ok {
+			reasons = append(reasons, closed.Reasons...)
+		}
+	}
+	if len(reasons) > 0 {
+		return Closed{Environment: env, Reasons: reasons}
+	}
+	return nil
+}
+
+//CheckChangeWindows returns Closed if env is protected and now is outside
+//of every change window its policy requires
+func CheckChangeWindows(p config.PolicyConfig, env string, now time.Time) error {
+	pe, ok := Protected(p, env)
+	if !ok || len(pe.ChangeWindows) == 0 {
+		return nil
+	}
+	in, err := InWindow(pe.ChangeWindows, now)
+	if err != nil {
+		return Closed{Environment: env, Reasons: []string{err.Error()}}
+	}
+	if !in {
+		return Closed{Environment: env, Reasons: []string{"outside of the policy change windows: " + describeWindows(pe.ChangeWindows)}}
+	}
+	return nil
+}
+
+//CheckCalendar returns Closed if now falls in a freeze or outside of every
+//change window of the calendar
+func CheckCalendar(cal config.Calendar, env string, now time.Time) error {
+	reasons := []string{}
+	for _, f := range cal.Freezes {
+		in, err := inFreeze(f, now)
+		if err != nil {
+			reasons = append(reasons, err.Error())
+		} else if in {
+			reason := f.Reason
+			if reason == "" {
+				reason = "no reason given"
+			}
+			reasons = append(reasons, fmt.Sprintf("frozen from %s to %s: %s", f.Start, f.End, reason))
+		}
+	}
+	if len(cal.Windows) > 0 {
+		in, err := InWindow(cal.Windows, now)
+		if err != nil {
+			reasons = append(reasons, err.Error())
+		} else if !in {
+			reasons = append(reasons, "outside of the change windows: "+describeWindows(cal.Windows))
+		}
+	}
+	if len(reasons) > 0 {
+		return Closed{Environment: env, Reasons: reasons}
+	}
+	return nil
+}
+
+//inFreeze returns true if now falls between the start and end of a freeze
+func inFreeze(f config.Freeze, now time.Time) (bool, error) {
+	start, _, err := freezeTime(f.Start)
+	if err != nil {
+		return false, err
+	}
+	end, date, err := freezeTime(f.End)
+	if err != nil {
+		return false, err
+	}
+	if date {
+		//the whole of the last day is frozen
+		end = end.AddDate(0, 0, 1)
+	}
+	return !now.Before(start) && now.Before(end), nil
+}
+
+//freezeTime parses the start or end of a freeze. The bool is true when
+//only a date was given
+func freezeTime(s string) (time.Time, bool, error) {
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		return t, true, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return t, false, fmt.Errorf("invalid freeze time %q, expected 2006-01-02 or RFC3339", s)
+	}
+	return t, false, nil
+}
+
+//InWindow returns true if now falls in any of the change windows. A
+//window that ends before it starts runs past midnight
+func InWindow(windows []config.ChangeWindow, now time.Time) (bool, error) {
+	for _, w := range windows {
+		loc := time.Local
+		if w.TimeZone != "" {
+			var err error
+			if loc, err = time.LoadLocation(w.TimeZone); err != nil {
+				return false, fmt.Errorf("invalid change window time zone %s", w.TimeZone)
+			}
+		}
+		start, err := minutes(w.Start)
+		if err != nil {
+			return false, err
+		}
+		end, err := minutes(w.End)
+		if err != nil {
+			return false, err
+		}
+
+		t := now.In(loc)
+		m := t.Hour()*60 + t.Minute()
+		day := t.Weekday()
+		if end <= start && m < end {
+			//early morning part of a window that started the day before
+			day = (day + 6) % 7
+		}
+		if !onDay(w.Days, day) {
+			continue
+		}
+		if start < end && m >= start && m < end {
+			return true, nil
+		}
+		if end <= start && (m >= start || m < end) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+//minutes parses a 15:04 time into minutes past midnight
+func minutes(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid change window time %q, expected HH:MM", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+//onDay returns true if day is one of days, or days is empty
+func onDay(days []string, day time.Weekday) bool {
+	if len(days) == 0 {
+		return true
+	}
+	for _, d := range days {
+		if len(d) >= 3 && strings.EqualFold(d[:3], day.String()[:3]) {
+			return true
+		}
+	}
+	return false
+}
+
+//describeWindows lists change windows for an error message
+func describeWindows(windows []config.ChangeWindow) string {
+	all := []string{}
+	for _, w := range windows {
+		days := "daily"
+		if len(w.Days) > 0 {
+			days = strings.Join(w.Days, ",")
+		}
+		desc := fmt.Sprintf("%s %s-%s", days, w.Start, w.End)
+		if w.TimeZone != "" {
+			desc += " " + w.TimeZone
+		}
+		all = append(all, desc)
+	}
+	return strings.Join(all, "; ")
+}
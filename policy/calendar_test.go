@@ -0,0 +1,152 @@
+package policy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mkobaly/devop/config"
+)
+
+var (
+	monday    = time.Date(2026, 10, 19, 10, 0, 0, 0, time.UTC)
+	tuesday   = time.Date(2026, 10, 20, 21, 0, 0, 0, time.UTC)
+	wednesday = time.Date(2026, 10, 21, 1, 30, 0, 0, time.UTC)
+)
+
+var weekdays = config.ChangeWindow{Days: []string{"Mon", "Tue", "Wed", "Thu", "Fri"}, Start: "08:00", End: "18:00", TimeZone: "UTC"}
+var evenings = config.ChangeWindow{Days: []string{"Tue", "Thu"}, Start: "20:00", End: "23:00", TimeZone: "UTC"}
+var overnight = config.ChangeWindow{Days: []string{"Tue"}, Start: "22:00", End: "02:00", TimeZone: "UTC"}
+
+func TestCalendarFor(t *testing.T) {
+	holiday := config.Freeze{Start: "2026-12-20", End: "2026-12-31", Reason: "holidays"}
+	c := &config.Config{
+		Calendar: map[string]config.Calendar{
+			"default": {Windows: []config.ChangeWindow{weekdays}, Freezes: []config.Freeze{holiday}},
+			"staging": {Windows: []config.ChangeWindow{overnight}},
+		},
+		Policy: config.PolicyConfig{
+			Protected: []config.ProtectedEnvironment{{Name: "Production", ChangeWindows: []config.ChangeWindow{evenings}}},
+		},
+	}
+	tests := []struct {
+		env     string
+		windows []config.ChangeWindow
+	}{
+		{"production", []config.ChangeWindow{weekdays}},
+		{"staging", []config.ChangeWindow{overnight}},
+		{"dev", []config.ChangeWindow{weekdays}},
+	}
+	for _, test := range tests {
+		cal := CalendarFor(c, test.env)
+		if len(cal.Windows) != len(test.windows) {
+			t.Errorf("%s: expected windows %v, got %v", test.env, test.windows, cal.Windows)
+			continue
+		}
+		for i := range test.windows {
+			if cal.Windows[i].Start != test.windows[i].Start || cal.Windows[i].End != test.windows[i].End {
+				t.Errorf("%s: expected windows %v, got %v", test.env, test.windows, cal.Windows)
+			}
+		}
+		if len(cal.Freezes) != 1 {
+			t.Errorf("%s: expected the default freeze, got %v", test.env, cal.Freezes)
+		}
+	}
+
+}
+
+func TestCheckDeployTime(t *testing.T) {
+	allDay := config.ChangeWindow{Start: "00:00", End: "23:59", TimeZone: "UTC"}
+	c := &config.Config{
+		Calendar: map[string]config.Calendar{
+			"default":    {Windows: []config.ChangeWindow{weekdays}},
+			"production": {Windows: []config.ChangeWindow{allDay}},
+		},
+		Policy: config.PolicyConfig{
+			Protected: []config.ProtectedEnvironment{{Name: "Production", ChangeWindows: []config.ChangeWindow{evenings}}},
+		},
+	}
+	tests := []struct {
+		name   string
+		env    string
+		now    time.Time
+		closed bool
+	}{
+		{"outside policy windows", "production", monday, true},
+		{"in both", "production", tuesday, false},
+		{"outside calendar", "dev", tuesday, true},
+		{"unprotected", "dev", monday, false},
+	}
+	for _, test := range tests {
+		err := CheckDeployTime(c, test.env, test.now)
+		if test.closed && err == nil {
+			t.Errorf("%s: expected closed", test.name)
+		}
+		if !test.closed && err != nil {
+			t.Errorf("%s: expected open, got %s", test.name, err)
+		}
+	}
+}
+
+func TestCheckCalendar(t *testing.T) {
+	freeze := config.Freeze{Start: "2026-10-19", End: "2026-10-19", Reason: "release day"}
+	tests := []struct {
+		name   string
+		cal    config.Calendar
+		now    time.Time
+		closed bool
+	}{
+		{"no calendar", config.Calendar{}, monday, false},
+		{"in window", config.Calendar{Windows: []config.ChangeWindow{weekdays}}, monday, false},
+		{"outside window", config.Calendar{Windows: []config.ChangeWindow{evenings}}, monday, true},
+		{"frozen", config.Calendar{Freezes: []config.Freeze{freeze}}, monday.In(time.Local), true},
+		{"after freeze", config.Calendar{Freezes: []config.Freeze{freeze}}, tuesday.AddDate(0, 0, 1).In(time.Local), false},
+		{"invalid freeze", config.Calendar{Freezes: []config.Freeze{{Start: "soon", End: "later"}}}, monday, true},
+	}
+	for _, test := range tests {
+		err := CheckCalendar(test.cal, "production", test.now)
+		if test.closed && err == nil {
+			t.Errorf("%s: expected closed", test.name)
+		}
+		if !test.closed && err != nil {
+			t.Errorf("%s: expected open, got %s", test.name, err)
+		}
+		if err != nil {
+			if _, ok := err.(Closed); !ok {
+				t.Errorf("%s: expected Closed, got %T", test.name, err)
+			}
+		}
+	}
+}
+
+func TestInWindow(t *testing.T) {
+	tests := []struct {
+		name    string
+		windows []config.ChangeWindow
+		now     time.Time
+		in      bool
+	}{
+		{"weekday", []config.ChangeWindow{weekdays}, monday, true},
+		{"wrong day", []config.ChangeWindow{evenings}, monday, false},
+		{"evening", []config.ChangeWindow{evenings}, tuesday, true},
+		{"any of several", []config.ChangeWindow{evenings, weekdays}, monday, true},
+		{"every day", []config.ChangeWindow{{Start: "09:00", End: "11:00", TimeZone: "UTC"}}, monday, true},
+		{"before midnight", []config.ChangeWindow{overnight}, tuesday.Add(90 * time.Minute), true},
+		{"after midnight", []config.ChangeWindow{overnight}, wednesday, true},
+		{"after midnight wrong day", []config.ChangeWindow{overnight}, monday.Add(-9 * time.Hour), false},
+		{"time zone", []config.ChangeWindow{{Start: "06:00", End: "07:00", TimeZone: "America/New_York"}}, monday, true},
+	}
+	for _, test := range tests {
+		in, err := InWindow(test.windows, test.now)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if in != test.in {
+			t.Errorf("%s: expected %t, got %t", test.name, test.in, in)
+		}
+	}
+
+	if _, err := InWindow([]config.ChangeWindow{{Start: "8am", End: "18:00"}}, monday); err == nil {
+		t.Error("expected an error for an invalid start time")
+	}
+}
@@ -0,0 +1,90 @@
+package policy
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mkobaly/devop/config"
+)
+
+//Request is a deployment to check against the policy. Epic is the Jira
+//epic being deployed and EpicStatus the status it is in, both blank when
+//not deploying an epic
+type Request struct {
+	Environment string
+	User        string
+	Groups      []string
+	Epic        string
+	EpicStatus  string
+	Now         time.Time
+}
+
+//Violation lists every rule of a protected environment a deployment breaks
+type Violation struct {
+	Environment string
+	Reasons     []string
+}
+
+func (v Violation) Error() string {
+	return fmt.Sprintf("Deploying to %s is not allowed:\n\t%s", v.Environment, strings.Join(v.Reasons, "\n\t"))
+}
+
+//Protected returns the protection configured for an environment. Names
+//are matched ignoring case
+func Protected(p config.PolicyConfig, env string) (config.ProtectedEnvironment, bool) {
+	for _, pe := range p.Protected {
+		if strings.EqualFold(pe.Name, env) {
+			return pe, true
+		}
+	}
+	return config.ProtectedEnvironment{}, false
+}
+
+//NeedsUser returns true if the user deploying has to be known to check pe
+func NeedsUser(pe config.ProtectedEnvironment) bool {
+	return len(pe.Users) > 0 || len(pe.Groups) > 0
+}
+
+//Check returns a Violation if the request breaks any rule of pe. Typed
+//confirmation is left to the caller since it needs the user at a terminal
+//and change windows are checked with the rest of the calendar
+func Check(pe config.ProtectedEnvironment, r Request) error {
+	reasons := []string{}
+	if !allowed(pe, r) {
+		if NeedsUser(pe) {
+			reasons = append(reasons, fmt.Sprintf("%s is not one of the users or groups allowed to deploy here", r.User))
+		} else {
+			reasons = append(reasons, "nobody is allowed to deploy here")
+		}
+	}
+	if pe.JiraStatus != "" {
+		switch {
+		case r.Epic == "":
+			reasons = append(reasons, fmt.Sprintf("only a Jira epic in status %s can be deployed here", pe.JiraStatus))
+		case !strings.EqualFold(r.EpicStatus, pe.JiraStatus):
+			reasons = append(reasons, fmt.Sprintf("epic %s is %s but must be %s", r.Epic, r.EpicStatus, pe.JiraStatus))
+		}
+	}
+	if len(reasons) > 0 {
+		return Violation{Environment: pe.Name, Reasons: reasons}
+	}
+	return nil
+}
+
+//allowed returns true if the user or one of their groups may deploy
+func allowed(pe config.ProtectedEnvironment, r Request) bool {
+	for _, u := range pe.Users {
+		if strings.EqualFold(u, r.User) {
+			return true
+		}
+	}
+	for _, g := range pe.Groups {
+		for _, mine := range r.Groups {
+			if strings.EqualFold(g, mine) {
+				return true
+			}
+		}
+	}
+	return false
+}
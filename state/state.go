@@ -0,0 +1,154 @@
+package state
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/mkobaly/devop/teamcity"
+)
+
+//Stages a pipeline item moves through, in order
+const (
+	StageBuild   = "build"
+	StageRelease = "release"
+	StageDeploy  = "deploy"
+)
+
+//Outcomes of the stage an item has reached
+const (
+	Running = "running"
+	Success = "success"
+	Failed  = "failed"
+)
+
+var stageOrder = map[string]int{StageBuild: 1, StageRelease: 2, StageDeploy: 3}
+
+//Item is a single project tracked through a build or assemble run
+type Item struct {
+	BuildConfigID string
+	Branch        string
+	After         []string          `json:",omitempty"`
+	Params        map[string]string `json:",omitempty"`
+	Tags          []string          `json:",omitempty"`
+	Environment   string            `json:",omitempty"`
+	BuildID       int64             `json:",omitempty"`
+	BuildHREF     string            `json:",omitempty"`
+	BuildStatus   string            `json:",omitempty"`
+	Project       string            `json:",omitempty"`
+	Version       string            `json:",omitempty"`
+	TaskID        string            `json:",omitempty"`
+	Stage         string            `json:",omitempty"`
+	Outcome       string            `json:",omitempty"`
+	Error         string            `json:",omitempty"`
+}
+
+//BuildInfo returns the Teamcity build configuration and branch of the item
+func (i *Item) BuildInfo() teamcity.BuildInfo {
+	return teamcity.BuildInfo{
+		BuildConfigID: i.BuildConfigID,
+		Branch:        i.Branch,
+		After:         i.After,
+		Params:        i.Params,
+		Tags:          i.Tags,
+		Project:       i.Project,
+		Environment:   i.Environment,
+	}
+}
+
+//Completed returns true if the item already made it successfully through stage
+func (i *Item) Completed(stage string) bool {
+	if stageOrder[i.Stage] > stageOrder[stage] {
+		return true
+	}
+	return i.Stage == stage && i.Outcome == Success
+}
+
+//InFlight returns true if the item was left running in stage
+func (i *Item) InFlight(stage string) bool {
+	return i.Stage == stage && i.Outcome == Running
+}
+
+//Set records the stage reached and its outcome
+func (i *Item) Set(stage string, outcome string, err error) {
+	i.Stage = stage
+	i.Outcome = outcome
+	i.Error = ""
+	if err != nil {
+		i.Error = err.Error()
+	}
+}
+
+//Run is the state of a build or assemble run persisted to disk so it
+//can be resumed later
+type Run struct {
+	Command string
+	Started time.Time
+	Updated time.Time
+	EpicKey string `json:",omitempty"`
+	//FreezeOverride is the reason given for deploying during a freeze
+	FreezeOverride string `json:",omitempty"`
+	Items          []*Item
+
+	path string
+	mu   sync.Mutex
+}
+
+//New creates a new run that will be saved to path. An empty path
+//creates a run that is never written to disk
+func New(path string, command string) *Run {
+	return &Run{path: path, Command: command, Started: time.Now()}
+}
+
+//Load reads a previously saved run so it can be resumed
+func Load(path string) (*Run, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var r = new(Run)
+	if err := json.Unmarshal(data, r); err != nil {
+		return nil, err
+	}
+	r.path = path
+	return r, nil
+}
+
+//Running returns the number of items the run left building or deploying
+func (r *Run) Running() int {
+	n := 0
+	for _, i := range r.Items {
+		if i.Outcome == Running {
+			n++
+		}
+	}
+	return n
+}
+
+//Path returns the file the run is saved to
+func (r *Run) Path() string {
+	return r.path
+}
+
+//Save writes the run to disk. The file is replaced atomically so an
+//interrupted save never leaves a truncated state file behind
+func (r *Run) Save() error {
+	if r.path == "" {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.Updated = time.Now()
+	data, err := json.MarshalIndent(r, "", "\t")
+	if err != nil {
+		return err
+	}
+	tmp := r.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, r.path)
+}
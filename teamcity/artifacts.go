@@ -0,0 +1,214 @@
+package teamcity
+
+import (
+	"bufio"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+//Artifact is a file published by a build. Name is the full path of the
+//file within the build's artifacts
+type Artifact struct {
+	Name string
+	Size int64
+}
+
+//Download is an artifact saved to disk. Checksum is the sha256 of the
+//file and Verified is the checksum artifact it was verified against, if any
+type Download struct {
+	Artifact
+	Path     string
+	Checksum string
+	Verified string
+}
+
+//checksums are the companion files a build can publish next to an
+//artifact to have its download verified, ex app.zip.sha256
+var checksums = map[string]func() hash.Hash{
+	".sha256": sha256.New,
+	".sha1":   sha1.New,
+	".md5":    md5.New,
+}
+
+//GetArtifacts lists every file the build published, including files in
+//sub directories
+func (t *Tracker) GetArtifacts(ctx context.Context) ([]Artifact, error) {
+	var result struct {
+		File []struct {
+			FullName string `json:"fullName"`
+			Size     int64  `json:"size"`
+			Content  *struct {
+				HREF string `json:"href"`
+			} `json:"content"`
+		} `json:"file"`
+	}
+	path := t.artifactsPath() + "children?locator=recursive:true&fields=" +
+		url.QueryEscape("file(fullName,size,content(href))")
+	if err := t.builder.do(ctx, "GET", path, nil, &result); err != nil {
+		return nil, err
+	}
+
+	artifacts := []Artifact{}
+	for _, f := range result.File {
+		//directories have no content
+		if f.Content != nil {
+			artifacts = append(artifacts, Artifact{Name: f.FullName, Size: f.Size})
+		}
+	}
+	return artifacts, nil
+}
+
+//DownloadArtifacts saves the build's artifacts to dir keeping their
+//directory structure. Only artifacts matching one of patterns are saved,
+//all of them when no patterns are given. Each download is checked against
+//the size Teamcity reports and against a published .sha256, .sha1 or .md5
+//checksum artifact when there is one
+func (t *Tracker) DownloadArtifacts(ctx context.Context, dir string, patterns []string) ([]Download, error) {
+	artifacts, err := t.GetArtifacts(ctx)
+	if err != nil {
+		return nil, err
+	}
+	byName := map[string]bool{}
+	for _, a := range artifacts {
+		byName[a.Name] = true
+	}
+
+	downloads := []Download{}
+	for _, a := range artifacts {
+		if !MatchArtifact(a.Name, patterns) {
+			continue
+		}
+		d, err := t.download(ctx, a, dir)
+		if err != nil {
+			return downloads, fmt.Errorf("%s: %s", a.Name, err)
+		}
+		for ext, h := range checksums {
+			if !byName[a.Name+ext] {
+				continue
+			}
+			if err := t.verify(ctx, d, a.Name+ext, h); err != nil {
+				os.Remove(d.Path)
+				return downloads, fmt.Errorf("%s: %s", a.Name, err)
+			}
+			d.Verified = a.Name + ext
+			break
+		}
+		downloads = append(downloads, d)
+	}
+	return downloads, nil
+}
+
+//MatchArtifact returns true if the artifact's full name or file name
+//matches one of the glob patterns, or there are no patterns
+func MatchArtifact(name string, patterns []string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+		if ok, _ := path.Match(p, path.Base(name)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+//download saves a single artifact under dir. The file is written to a
+//temporary name first so a failed download never leaves a partial file
+func (t *Tracker) download(ctx context.Context, a Artifact, dir string) (Download, error) {
+	d := Download{Artifact: a}
+	target := filepath.Join(dir, filepath.FromSlash(a.Name))
+	rel, err := filepath.Rel(dir, target)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return d, errors.New("artifact path is outside of the download directory")
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return d, err
+	}
+
+	resp, err := t.builder.send(ctx, "GET", t.artifactsPath()+"content/"+escapePath(a.Name), nil)
+	if err != nil {
+		return d, err
+	}
+	defer resp.Body.Close()
+
+	tmp := target + ".download"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return d, err
+	}
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(file, h), resp.Body)
+	file.Close()
+	if err == nil && n != a.Size {
+		err = fmt.Errorf("downloaded %d bytes but Teamcity reported %d", n, a.Size)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return d, err
+	}
+	if err := os.Rename(tmp, target); err != nil {
+		return d, err
+	}
+	d.Path = target
+	d.Checksum = hex.EncodeToString(h.Sum(nil))
+	return d, nil
+}
+
+//verify compares a downloaded file against the checksum published in the
+//checksum artifact. The checksum is the first field of the file so both a
+//bare hash and sha256sum style output are understood
+func (t *Tracker) verify(ctx context.Context, d Download, checksumName string, newHash func() hash.Hash) error {
+	resp, err := t.builder.send(ctx, "GET", t.artifactsPath()+"content/"+escapePath(checksumName), nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return err
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return errors.New("checksum file " + checksumName + " is empty")
+	}
+
+	file, err := os.Open(d.Path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	h := newHash()
+	if _, err := io.Copy(h, file); err != nil {
+		return err
+	}
+	if actual := hex.EncodeToString(h.Sum(nil)); !strings.EqualFold(actual, fields[0]) {
+		return fmt.Errorf("checksum mismatch, %s says %s but downloaded file is %s", checksumName, fields[0], actual)
+	}
+	return nil
+}
+
+//artifactsPath is the REST path of the build's artifacts
+func (t *Tracker) artifactsPath() string {
+	return "/httpAuth/app/rest/builds/id:" + strconv.FormatInt(t.Build.ID, 10) + "/artifacts/"
+}
+
+//escapePath escapes an artifact path for use in a url
+func escapePath(p string) string {
+	return (&url.URL{Path: p}).EscapedPath()
+}
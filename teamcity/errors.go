@@ -0,0 +1,94 @@
+package teamcity
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+//APIError is returned when Teamcity answers a request with an error
+//status. Message is the body of the response
+type APIError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e APIError) Error() string {
+	msg := e.Message
+	if msg == "" {
+		msg = http.StatusText(e.StatusCode)
+	}
+	return fmt.Sprintf("teamcity %d: %s", e.StatusCode, msg)
+}
+
+//NotFoundError is returned when the requested build or resource does not exist
+type NotFoundError struct{ APIError }
+
+//UnauthorizedError is returned when the credentials are invalid or lack
+//permission for the request
+type UnauthorizedError struct{ APIError }
+
+//ServerError is returned when Teamcity fails to handle the request or is
+//too busy to. These are worth retrying
+type ServerError struct{ APIError }
+
+//NetworkError is returned when Teamcity could not be reached at all
+type NetworkError struct {
+	Err error
+}
+
+func (e NetworkError) Error() string {
+	return "teamcity unreachable: " + e.Err.Error()
+}
+
+//PollError is returned once polling has failed too many times in a row
+type PollError struct {
+	Failures int
+	Err      error
+}
+
+func (e PollError) Error() string {
+	return fmt.Sprintf("Giving up polling Teamcity after %d failures in a row: %s", e.Failures, e.Err)
+}
+
+//IsNotFound returns true if err is a NotFoundError
+func IsNotFound(err error) bool {
+	_, ok := err.(NotFoundError)
+	return ok
+}
+
+//IsUnauthorized returns true if err is an UnauthorizedError
+func IsUnauthorized(err error) bool {
+	_, ok := err.(UnauthorizedError)
+	return ok
+}
+
+//IsTemporary returns true if err is a failure that may go away when the
+//request is tried again
+func IsTemporary(err error) bool {
+	switch err.(type) {
+	case ServerError, NetworkError:
+		return true
+	}
+	return false
+}
+
+//newAPIError reads the error message from a failed response and wraps it
+//in the error type matching the status code
+func newAPIError(resp *http.Response) error {
+	e := APIError{StatusCode: resp.StatusCode}
+	if body, err := ioutil.ReadAll(resp.Body); err == nil {
+		e.Message = strings.TrimSpace(string(body))
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return NotFoundError{e}
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return UnauthorizedError{e}
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return ServerError{e}
+	}
+	return e
+}
@@ -0,0 +1,200 @@
+package teamcity
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+//ManifestVersion is the only version of the build manifest understood
+const ManifestVersion = 1
+
+//Manifest is the structured (yaml or json) form of a build file
+//
+//	version: 1
+//	builds:
+//	  - id: ServiceA_Release
+//	    branch: develop
+//	    params:
+//	      env.VersionSuffix: beta
+//	    tags: [services]
+//	    project: ServiceA
+//	    environment: staging
+//	    after: [SharedLib_Release]
+type Manifest struct {
+	Version int             `yaml:"version" json:"version"`
+	Builds  []ManifestEntry `yaml:"builds" json:"builds"`
+}
+
+//ManifestEntry is a single build in a Manifest. Project is the Octopus
+//project the build is released to when it differs from the Teamcity
+//project name and Environment is where assemble deploys it. After lists
+//build ids, or id@branch to wait for only one branch of a build
+type ManifestEntry struct {
+	ID          string            `yaml:"id" json:"id"`
+	Branch      string            `yaml:"branch" json:"branch"`
+	Params      map[string]string `yaml:"params" json:"params"`
+	Tags        []string          `yaml:"tags" json:"tags"`
+	Project     string            `yaml:"project" json:"project"`
+	Environment string            `yaml:"environment" json:"environment"`
+	After       []string          `yaml:"after" json:"after"`
+}
+
+//ParseError lists every problem found in a build file
+type ParseError struct {
+	Path   string
+	Errors []string
+}
+
+func (e ParseError) Error() string {
+	return fmt.Sprintf("Invalid build file %s:\n\t%s", e.Path, strings.Join(e.Errors, "\n\t"))
+}
+
+//isManifest returns true if the build file should be read as a manifest
+//rather than the plain text format
+func isManifest(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml", ".json":
+		return true
+	}
+	return false
+}
+
+//parseManifest reads a yaml or json build manifest
+func parseManifest(path string) ([]BuildInfo, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var m Manifest
+	var lines []int
+	if strings.ToLower(filepath.Ext(path)) == ".json" {
+		err = json.Unmarshal(data, &m)
+		lines = jsonEntryLines(data)
+	} else {
+		err = yaml.Unmarshal(data, &m)
+		lines = yamlEntryLines(data)
+	}
+	if err != nil {
+		return nil, ParseError{Path: path, Errors: []string{err.Error()}}
+	}
+
+	if m.Version != ManifestVersion {
+		return nil, ParseError{Path: path, Errors: []string{
+			fmt.Sprintf("unsupported manifest version %d, expected version: %d", m.Version, ManifestVersion)}}
+	}
+
+	errs := []string{}
+	seen := map[string]string{}
+	builds := []BuildInfo{}
+	for i, e := range m.Builds {
+		line := 0
+		where := fmt.Sprintf("builds[%d]", i)
+		if i < len(lines) {
+			line = lines[i]
+			where = fmt.Sprintf("line %d", line)
+		}
+		if e.ID == "" {
+			errs = append(errs, where+": id is required")
+			continue
+		}
+		key := e.ID + " " + e.Branch
+		if first, ok := seen[key]; ok {
+			errs = append(errs, fmt.Sprintf("%s: %s is already listed at %s", where, onBranch(e.ID, e.Branch), first))
+			continue
+		}
+		seen[key] = where
+		builds = append(builds, BuildInfo{
+			BuildConfigID: e.ID,
+			Branch:        e.Branch,
+			Params:        e.Params,
+			Tags:          e.Tags,
+			Project:       e.Project,
+			Environment:   e.Environment,
+			After:         e.After,
+			Line:          line,
+		})
+	}
+	if len(errs) > 0 {
+		return nil, ParseError{Path: path, Errors: errs}
+	}
+	return builds, nil
+}
+
+//yamlEntryLines returns the line each entry of the builds list starts on.
+//Only block style lists are understood, nothing is returned for a flow
+//style list
+func yamlEntryLines(data []byte) []int {
+	result := []int{}
+	inBuilds := false
+	indent := -1
+	for i, l := range strings.Split(string(data), "\n") {
+		text := strings.TrimSpace(l)
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		depth := len(l) - len(strings.TrimLeft(l, " "))
+		if !inBuilds {
+			inBuilds = depth == 0 && strings.HasPrefix(text, "builds:")
+			if inBuilds && strings.TrimSpace(strings.TrimPrefix(text, "builds:")) != "" {
+				return nil
+			}
+			continue
+		}
+		if indent < 0 {
+			indent = depth
+		}
+		if depth < indent || (depth == indent && !strings.HasPrefix(text, "-")) {
+			break
+		}
+		if depth == indent {
+			result = append(result, i+1)
+		}
+	}
+	return result
+}
+
+//jsonEntryLines returns the line each entry of the builds array starts on
+func jsonEntryLines(data []byte) []int {
+	result := []int{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if t, err := dec.Token(); err != nil || t != json.Delim('{') {
+		return nil
+	}
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return nil
+		}
+		if key != "builds" {
+			var skip json.RawMessage
+			if err := dec.Decode(&skip); err != nil {
+				return nil
+			}
+			continue
+		}
+		if t, err := dec.Token(); err != nil || t != json.Delim('[') {
+			return nil
+		}
+		for dec.More() {
+			//the offset is just past the previous token so skip to the entry
+			offset := int(dec.InputOffset())
+			for offset < len(data) && strings.ContainsRune(" \t\r\n,", rune(data[offset])) {
+				offset++
+			}
+			result = append(result, bytes.Count(data[:offset], []byte("\n"))+1)
+			var entry json.RawMessage
+			if err := dec.Decode(&entry); err != nil {
+				return nil
+			}
+		}
+		return result
+	}
+	return result
+}
@@ -2,122 +2,231 @@ package teamcity
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
 	"os"
-	"strconv"
 	"strings"
-	// "fmt"
-	// "io/ioutil"
-	"net/http"
 
 	"github.com/mkobaly/devop/config"
+	"github.com/mkobaly/devop/transport"
 	"github.com/mkobaly/teamcity"
 )
 
-//BuildInfo represents a Build Configuration and branch in Teamcity
+//BuildInfo represents a Build Configuration and branch in Teamcity.
+//After lists the build configurations that must build successfully first.
+//Params are sent to Teamcity with the build while Project and Environment
+//are the Octopus project and environment the build is released and
+//deployed to (blank to use the defaults). Line is where the build is
+//listed in its build file, 0 when it didn't come from one
 type BuildInfo struct {
 	BuildConfigID string
 	Branch        string
+	After         []string
+	Params        map[string]string
+	Tags          []string
+	Project       string
+	Environment   string
+	Line          int
 }
 
-type IBuilder interface {
-	//Build(id string, branch string) error
-	Build() error
-	Done() <-chan struct{}
-	Result() interface{}
+//HasTag returns true if the build has any of the tags, or no tags are given
+func (bi BuildInfo) HasTag(tags []string) bool {
+	if len(tags) == 0 {
+		return true
+	}
+	for _, t := range bi.Tags {
+		for _, want := range tags {
+			if strings.EqualFold(t, want) {
+				return true
+			}
+		}
+	}
+	return false
 }
 
+//Builder queues and polls builds on Teamcity. It holds no state about
+//any single build so one Builder can be shared by many builds; each
+//queued build gets its own Tracker instead. Every request it makes goes
+//through the shared transport.Client. MaxPollFailures is how many polls in
+//a row may fail before watching builds gives up
 type Builder struct {
-	Credentials config.UserCredential
-	BuildInfo   BuildInfo
-	// buildID     string
-	// branch      string
-	client      *teamcity.Client
-	BuildResult *teamcity.Build
+	Credentials     config.UserCredential
+	MaxPollFailures int
+	http            *http.Client
 }
 
+//DefaultMaxPollFailures is the MaxPollFailures of builders created with New
+const DefaultMaxPollFailures = 5
+
 //New will create a new teamcity Builder
 func New(creds config.UserCredential) *Builder {
 	var b = new(Builder)
 	b.Credentials = creds
-	//b.BuildInfo = buildInfo
-	//b.branch = branch
-	//b.buildID = buildID
-	b.client = teamcity.New(creds.URL, creds.Username, creds.Password)
+	b.MaxPollFailures = DefaultMaxPollFailures
+	b.http = transport.Client
 	return b
 }
 
-func (b *Builder) SetBuildInfo(bi BuildInfo) error {
-	b.BuildInfo = bi
-	b.BuildResult = new(teamcity.Build)
-	return nil
+//Queue will kick off a TeamCity build and return a tracker for it
+func (b *Builder) Queue(ctx context.Context, bi BuildInfo) (*Tracker, error) {
+	if bi.BuildConfigID == "" {
+		return nil, errors.New("Build Info not set yet so unable to build")
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	type property struct {
+		Name  string `json:"name"`
+		Value string `json:"value"`
+	}
+	data := struct {
+		BuildType struct {
+			ID string `json:"id"`
+		} `json:"buildType"`
+		BranchName string `json:"branchName,omitempty"`
+		Properties struct {
+			Property []property `json:"property"`
+		} `json:"properties"`
+	}{}
+	data.BuildType.ID = bi.BuildConfigID
+	data.BranchName = bi.Branch
+	data.Properties.Property = []property{}
+	for name, value := range bi.Params {
+		data.Properties.Property = append(data.Properties.Property, property{name, value})
+	}
+
+	var x teamcity.Build
+	if err := b.do(ctx, "POST", "/httpAuth/app/rest/buildQueue", data, &x); err != nil {
+		return nil, err
+	}
+	return &Tracker{BuildInfo: bi, Build: &x, builder: b}, nil
+}
+
+//Track returns a tracker for a build that was already queued so it can
+//be polled again without queuing another one
+func (b *Builder) Track(bi BuildInfo, id int64, href string) *Tracker {
+	return &Tracker{BuildInfo: bi, Build: &teamcity.Build{ID: id, HREF: href}, builder: b}
 }
 
-//Build will kick off a TeamCity build
-func (b *Builder) Build() error {
-	if (BuildInfo{}) == b.BuildInfo {
-		return errors.New("Build Info not set yet so unable to build")
+//Poll refreshes every tracker that has not finished yet using a single
+//request to Teamcity no matter how many builds are being tracked
+func (b *Builder) Poll(ctx context.Context, trackers []*Tracker) error {
+	byID := map[int64]*Tracker{}
+	locator := []string{}
+	for _, t := range trackers {
+		if t.Finished() {
+			continue
+		}
+		byID[t.Build.ID] = t
+		locator = append(locator, fmt.Sprintf("item:(id:%d)", t.Build.ID))
 	}
-	//client := teamcity.New(b.Credentials.URL, b.Credentials.Username, b.Credentials.Password)
-	x, err := b.client.QueueBuild(b.BuildInfo.BuildConfigID, b.BuildInfo.Branch, nil)
-	if err != nil {
+	if len(locator) == 0 {
+		return nil
+	}
+
+	var result struct {
+		Build []teamcity.Build `json:"build"`
+	}
+	path := "/httpAuth/app/rest/builds?locator=" + url.QueryEscape(strings.Join(locator, ",")) +
+		"&fields=" + url.QueryEscape(buildFields)
+	if err := b.do(ctx, "GET", path, nil, &result); err != nil {
 		return err
 	}
-	b.BuildResult = x
+	for i := range result.Build {
+		if t, ok := byID[result.Build[i].ID]; ok {
+			t.Build = &result.Build[i]
+		}
+	}
 	return nil
 }
 
-func (b *Builder) BuildResultToJson() string {
-	r, _ := json.MarshalIndent(b.BuildResult, "", "\t")
-	return string(r)
-}
+//buildFields are the fields Poll asks Teamcity for on each build. The
+//build list only returns a short form of each build by default
+const buildFields = "build(id,number,status,statusText,state,buildTypeId,branchName,href,webUrl,buildType(id,name,projectName,projectId))"
 
-// //GetBuild will return the current state of the build
-func (b *Builder) GetBuild() error {
-	br, err := b.client.GetBuild(strconv.FormatInt(b.BuildResult.ID, 10))
-	b.BuildResult = br
-	return err
-}
+//do sends a request to the Teamcity REST API. body is sent as json when
+//not nil and a successful response is decoded into v when not nil
+func (b *Builder) do(ctx context.Context, method string, path string, body interface{}, v interface{}) error {
+	resp, err := b.send(ctx, method, path, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
 
-//VerifyBuildStatus will return the current state of the build
-func (b *Builder) VerifyBuildStatus() error {
-	client := &http.Client{}
-	req, _ := http.NewRequest("GET", b.Credentials.URL+b.BuildResult.HREF, nil)
-	req.SetBasicAuth(b.Credentials.Username, b.Credentials.Password)
-	req.Header.Set("Accept", "application/json")
-	req.Header.Set("Content-Type", "application/json")
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
 
-	resp, err := client.Do(req)
-	defer resp.Body.Close()
+//send sends a request to Teamcity and returns the response if it was
+//successful. The caller is responsible for closing the response body
+func (b *Builder) send(ctx context.Context, method string, path string, body interface{}) (*http.Response, error) {
+	var r io.Reader
+	if body != nil {
+		buf := new(bytes.Buffer)
+		if err := json.NewEncoder(buf).Encode(body); err != nil {
+			return nil, err
+		}
+		r = buf
+	}
 
+	req, err := http.NewRequest(method, b.Credentials.URL+path, r)
 	if err != nil {
-		panic(err.Error())
-	}
-	if err := json.NewDecoder(resp.Body).Decode(b.BuildResult); err != nil {
-		return err
+		return nil, err
 	}
-	return nil
-}
+	req.SetBasicAuth(b.Credentials.Username, b.Credentials.Password)
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/json")
 
-//GetArtifactVersion will return the version number of the build artifact
-func (b *Builder) GetArtifactVersion() (string, error) {
-	client := teamcity.New(b.Credentials.URL, b.Credentials.Username, b.Credentials.Password)
-	version, err := client.GetArtifact(b.BuildResult.ID)
+	resp, err := b.http.Do(req.WithContext(ctx))
 	if err != nil {
-		var s = strings.Replace(version.Name, ".zip", "", 1)
-		var parts = strings.Split(s, ".v")
-		if len(parts) == 2 {
-			return parts[1], nil
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
 		}
+		return nil, NetworkError{err}
 	}
-	return "", err
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		return nil, newAPIError(resp)
+	}
+	return resp, nil
 }
 
 //ParseBuildFile Will parse a build file that lists out each buildID [branch] that needs to be built
 //buildID is required but branch is not. It will default to master. BuildID and branch name
-//need to be separated by a space
+//need to be separated by whitespace. Blank lines and lines starting with # are ignored
+//
+//Dependencies are declared with after:buildA,buildB at the end of a line. A line
+//of --- starts a new stage where every build depends on the builds in the stage before it.
+//Build parameters are given as name=value and are sent to Teamcity with the build and
+//builds are tagged with tags:a,b. A build configuration may be listed once per branch,
+//depending on it waits for every one of them while buildA@develop waits for only one
+//
+//	# libraries first
+//	SharedLib_Release
+//	---
+//	ServiceA_Release master env.VersionSuffix=beta tags:services
+//	ServiceA_Release develop
+//	ServiceB_Release develop after:ServiceA_Release
+//
+//Files ending in .yaml, .yml or .json are read as a Manifest instead. Problems
+//are returned as a ParseError listing each one by line
 func ParseBuildFile(path string) ([]BuildInfo, error) {
+	if isManifest(path) {
+		builds, err := parseManifest(path)
+		if err != nil {
+			return nil, err
+		}
+		return builds, ValidateDependencies(builds)
+	}
+
 	file, err := os.Open(path)
 	if err != nil {
 		return nil, err
@@ -125,21 +234,219 @@ func ParseBuildFile(path string) ([]BuildInfo, error) {
 	defer file.Close()
 
 	var builds []BuildInfo
+	var previous, current []string
+	errs := []string{}
+	seen := map[string]int{}
+	line := 0
 	scanner := bufio.NewScanner(file)
 	for scanner.Scan() {
-		parts := strings.Split(scanner.Text(), " ")
-		branch := ""
-		if len(parts) > 1 {
-			branch = parts[1]
+		line++
+		parts := strings.Fields(scanner.Text())
+		for i, p := range parts {
+			if strings.HasPrefix(p, "#") {
+				parts = parts[:i]
+				break
+			}
+		}
+		if len(parts) == 0 {
+			continue
+		}
+		if parts[0] == "---" {
+			if len(current) > 0 {
+				previous, current = current, nil
+			}
+			continue
+		}
+		bi := BuildInfo{BuildConfigID: parts[0], Line: line}
+		bi.After = append(bi.After, previous...)
+		for _, p := range parts[1:] {
+			switch {
+			case strings.HasPrefix(p, "after:"):
+				after := strings.TrimPrefix(p, "after:")
+				if after == "" {
+					errs = append(errs, fmt.Sprintf("line %d: after: needs at least one build", line))
+					continue
+				}
+				bi.After = append(bi.After, strings.Split(after, ",")...)
+			case strings.HasPrefix(p, "tags:"):
+				tags := strings.TrimPrefix(p, "tags:")
+				if tags == "" {
+					errs = append(errs, fmt.Sprintf("line %d: tags: needs at least one tag", line))
+					continue
+				}
+				bi.Tags = append(bi.Tags, strings.Split(tags, ",")...)
+			case strings.Contains(p, "="):
+				name, value, err := ParseParam(p)
+				if err != nil {
+					errs = append(errs, fmt.Sprintf("line %d: %s", line, err))
+					continue
+				}
+				if bi.Params == nil {
+					bi.Params = map[string]string{}
+				}
+				bi.Params[name] = value
+			case bi.Branch == "":
+				bi.Branch = p
+			default:
+				errs = append(errs, fmt.Sprintf("line %d: unexpected %q, only one branch can be given", line, p))
+			}
+		}
+		key := bi.BuildConfigID + " " + bi.Branch
+		if first, ok := seen[key]; ok {
+			errs = append(errs, fmt.Sprintf("line %d: %s is already listed on line %d", line, onBranch(bi.BuildConfigID, bi.Branch), first))
+			continue
+		}
+		seen[key] = line
+		current = append(current, bi.Ref())
+		builds = append(builds, bi)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(errs) > 0 {
+		return nil, ParseError{Path: path, Errors: errs}
+	}
+	return builds, ValidateDependencies(builds)
+}
+
+//ParseParam splits a build parameter given as name=value. Teamcity
+//parameters are usually prefixed with env. or system. but any name is
+//passed through as is
+func ParseParam(p string) (string, string, error) {
+	i := strings.Index(p, "=")
+	if i <= 0 {
+		return "", "", fmt.Errorf("invalid parameter %q, expected name=value", p)
+	}
+	return p[:i], p[i+1:], nil
+}
+
+//onBranch names a build configuration and its branch for messages
+func onBranch(id string, branch string) string {
+	if branch == "" {
+		return id + " on the default branch"
+	}
+	return id + " on branch " + branch
+}
+
+//Ref returns the dependency that matches only this build, its build
+//configuration and branch as id@branch. The branch is blank for the
+//default branch
+func (bi BuildInfo) Ref() string {
+	return bi.BuildConfigID + "@" + bi.Branch
+}
+
+//Matches returns true if the dependency ref is this build. A ref is either
+//a build configuration id, matching every branch of it, or id@branch
+func (bi BuildInfo) Matches(ref string) bool {
+	return ref == bi.BuildConfigID || ref == bi.Ref()
+}
+
+//Dependencies returns the index of every build that builds[i] depends on.
+//A build never depends on itself so a build configuration listed for
+//several branches can depend on its other branches
+func Dependencies(builds []BuildInfo, i int) []int {
+	deps := []int{}
+	for j, b := range builds {
+		if j == i {
+			continue
+		}
+		for _, a := range builds[i].After {
+			if b.Matches(a) {
+				deps = append(deps, j)
+				break
+			}
+		}
+	}
+	return deps
+}
+
+//ValidateDependencies makes sure every build a build depends on is part of
+//the same set of builds and that there are no cycles between them
+func ValidateDependencies(builds []BuildInfo) error {
+	for i, b := range builds {
+		for _, a := range b.After {
+			found := false
+			for j, other := range builds {
+				if j != i && other.Matches(a) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return fmt.Errorf("%s%s depends on %s which is not being built", linePrefix(b), b.BuildConfigID, a)
+			}
+		}
+	}
+
+	//depth first search, a build seen again while still on the path is a cycle
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	marks := make([]int, len(builds))
+	var visit func(i int, path []string) error
+	visit = func(i int, path []string) error {
+		name := onBranch(builds[i].BuildConfigID, builds[i].Branch)
+		switch marks[i] {
+		case visiting:
+			return fmt.Errorf("Circular build dependency: %s", strings.Join(append(path, name), " -> "))
+		case visited:
+			return nil
+		}
+		marks[i] = visiting
+		for _, j := range Dependencies(builds, i) {
+			if err := visit(j, append(path, name)); err != nil {
+				return err
+			}
+		}
+		marks[i] = visited
+		return nil
+	}
+	for i := range builds {
+		if err := visit(i, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//ValidateBuildTypes makes sure every build is a build configuration
+//that exists on Teamcity
+func (b *Builder) ValidateBuildTypes(ctx context.Context, builds []BuildInfo) error {
+	types, err := b.GetBuilds(ctx)
+	if err != nil {
+		return err
+	}
+	known := map[string]bool{}
+	for _, t := range types {
+		known[t.ID] = true
+	}
+	unknown := []string{}
+	for _, bi := range builds {
+		if !known[bi.BuildConfigID] {
+			unknown = append(unknown, linePrefix(bi)+bi.BuildConfigID)
 		}
-		builds = append(builds, BuildInfo{BuildConfigID: parts[0], Branch: branch})
 	}
-	return builds, nil
+	if len(unknown) > 0 {
+		return errors.New("Unknown Teamcity build configuration(s):\n\t" + strings.Join(unknown, "\n\t"))
+	}
+	return nil
+}
+
+//linePrefix returns "line N: " for a build read from a build file
+func linePrefix(bi BuildInfo) string {
+	if bi.Line == 0 {
+		return ""
+	}
+	return fmt.Sprintf("line %d: ", bi.Line)
 }
 
 //GetBuilds will list out all available builds on TeamCity
-func (b *Builder) GetBuilds() ([]*teamcity.BuildType, error) {
-	//client := teamcity.New(b.Credentials.URL, b.Credentials.Username, b.Credentials.Password)
-	builds, err := b.client.GetBuildTypes()
-	return builds, err
+func (b *Builder) GetBuilds(ctx context.Context) ([]*teamcity.BuildType, error) {
+	var result struct {
+		BuildType []*teamcity.BuildType `json:"buildType"`
+	}
+	path := "/httpAuth/app/rest/buildTypes?fields=" + url.QueryEscape("buildType(id,name,projectName,projectId,href)")
+	err := b.do(ctx, "GET", path, nil, &result)
+	return result.BuildType, err
 }
@@ -0,0 +1,199 @@
+package teamcity
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mkobaly/teamcity"
+)
+
+//Tracker follows a single queued build. Results always stay paired with
+//the BuildInfo that started the build. Started and Ended are filled in by
+//GetBuild once Teamcity reports them
+type Tracker struct {
+	BuildInfo BuildInfo
+	Build     *teamcity.Build
+	Started   time.Time
+	Ended     time.Time
+	builder   *Builder
+}
+
+//dateFormat is how Teamcity formats the dates of a build
+const dateFormat = "20060102T150405-0700"
+
+//ID returns the Teamcity id of the build
+func (t *Tracker) ID() int64 {
+	return t.Build.ID
+}
+
+//Finished returns true once Teamcity reports the build as finished
+func (t *Tracker) Finished() bool {
+	return t.Build.State == "finished"
+}
+
+//Succeeded returns true if the build finished successfully
+func (t *Tracker) Succeeded() bool {
+	return t.Finished() && t.Build.Status == "SUCCESS"
+}
+
+func (t *Tracker) BuildResultToJson() string {
+	r, _ := json.MarshalIndent(t.Build, "", "\t")
+	return string(r)
+}
+
+//GetBuild will refresh the current state of the build
+func (t *Tracker) GetBuild(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	var br struct {
+		teamcity.Build
+		StartDate  string `json:"startDate"`
+		FinishDate string `json:"finishDate"`
+	}
+	path := "/httpAuth/app/rest/builds/id:" + strconv.FormatInt(t.Build.ID, 10)
+	if err := t.builder.do(ctx, "GET", path, nil, &br); err != nil {
+		return err
+	}
+	t.Build = &br.Build
+	t.Started, _ = time.Parse(dateFormat, br.StartDate)
+	t.Ended, _ = time.Parse(dateFormat, br.FinishDate)
+	return nil
+}
+
+//Duration returns how long the build has been running, or ran for once
+//it finished. It is 0 until the build starts
+func (t *Tracker) Duration() time.Duration {
+	if t.Started.IsZero() {
+		return 0
+	}
+	if t.Ended.IsZero() {
+		return time.Since(t.Started)
+	}
+	return t.Ended.Sub(t.Started)
+}
+
+//Cancel stops the build whether it is still sitting in the queue or is
+//already running on an agent
+func (t *Tracker) Cancel(ctx context.Context, comment string) error {
+	data := struct {
+		Comment        string `json:"comment"`
+		ReaddIntoQueue bool   `json:"readdIntoQueue"`
+	}{
+		comment,
+		false,
+	}
+	id := strconv.FormatInt(t.Build.ID, 10)
+	err := t.builder.do(ctx, "POST", "/httpAuth/app/rest/buildQueue/id:"+id, data, nil)
+	if err == nil {
+		return nil
+	}
+	//no longer queued so cancel the running build instead
+	return t.builder.do(ctx, "POST", "/httpAuth/app/rest/builds/id:"+id, data, nil)
+}
+
+//GetArtifactVersion will return the version number of the build artifact,
+//ex 1.2.3 from MyService.v1.2.3.zip
+func (t *Tracker) GetArtifactVersion(ctx context.Context) (string, error) {
+	return t.ResolveVersion(ctx, ArtifactVersion{Pattern: regexp.MustCompile(DefaultVersionPattern)})
+}
+
+//ResolveVersion returns the version of the finished build using r
+func (t *Tracker) ResolveVersion(ctx context.Context, r VersionResolver) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	return r.Resolve(ctx, t)
+}
+
+//Failure holds the details of why a build failed
+type Failure struct {
+	Problems    []string
+	FailedTests []string
+	LogTail     []string
+}
+
+//GetFailure fetches the problems, failed tests and the last logLines lines
+//of the build log for the build. A logLines of 0 skips the build log
+func (t *Tracker) GetFailure(ctx context.Context, logLines int) (Failure, error) {
+	var f Failure
+	id := strconv.FormatInt(t.Build.ID, 10)
+
+	var problems struct {
+		ProblemOccurrence []struct {
+			Type     string `json:"type"`
+			Identity string `json:"identity"`
+			Details  string `json:"details"`
+		} `json:"problemOccurrence"`
+	}
+	path := "/httpAuth/app/rest/problemOccurrences?locator=" + url.QueryEscape("build:(id:"+id+")") +
+		"&fields=" + url.QueryEscape("problemOccurrence(type,identity,details)")
+	if err := t.builder.do(ctx, "GET", path, nil, &problems); err != nil {
+		return f, err
+	}
+	for _, p := range problems.ProblemOccurrence {
+		detail := p.Details
+		if detail == "" {
+			detail = p.Identity
+		}
+		f.Problems = append(f.Problems, strings.TrimSpace(p.Type+": "+detail))
+	}
+
+	var tests struct {
+		TestOccurrence []struct {
+			Name string `json:"name"`
+		} `json:"testOccurrence"`
+	}
+	path = "/httpAuth/app/rest/testOccurrences?locator=" + url.QueryEscape("build:(id:"+id+"),status:FAILURE") +
+		"&fields=" + url.QueryEscape("testOccurrence(name)")
+	if err := t.builder.do(ctx, "GET", path, nil, &tests); err != nil {
+		return f, err
+	}
+	for _, test := range tests.TestOccurrence {
+		f.FailedTests = append(f.FailedTests, test.Name)
+	}
+
+	if logLines > 0 {
+		tail, err := t.logTail(ctx, logLines)
+		if err != nil {
+			return f, err
+		}
+		f.LogTail = tail
+	}
+	return f, nil
+}
+
+//logTail returns the last n lines of the build log. The log is streamed
+//so only n lines are ever held in memory
+func (t *Tracker) logTail(ctx context.Context, n int) ([]string, error) {
+	resp, err := t.builder.send(ctx, "GET", "/httpAuth/downloadBuildLog.html?buildId="+strconv.FormatInt(t.Build.ID, 10), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	lines := make([]string, 0, n)
+	r := bufio.NewReader(resp.Body)
+	for {
+		line, err := r.ReadString('\n')
+		if line != "" {
+			if len(lines) == n {
+				lines = lines[1:]
+			}
+			lines = append(lines, strings.TrimRight(line, "\r\n"))
+		}
+		if err == io.EOF {
+			return lines, nil
+		}
+		if err != nil {
+			return lines, err
+		}
+	}
+}
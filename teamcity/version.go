@@ -0,0 +1,253 @@
+package teamcity
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/mkobaly/devop/config"
+)
+
+//Version sources a VersionResolver can read from
+const (
+	VersionFromArtifact = "artifact"
+	VersionFromNumber   = "number"
+	VersionFromProperty = "property"
+	VersionFromTag      = "tag"
+)
+
+//DefaultVersionPattern matches the artifacts devop has always expected,
+//ex MyService.v1.2.3.zip. The version has to start with a digit and the
+//name end in .zip so files like app.vshost.exe are never matched
+const DefaultVersionPattern = `\.v(?P<version>\d[^/]*?)\.zip$`
+
+//defaultTagPattern matches semver tags with or without a leading v
+const defaultTagPattern = `^(refs/tags/)?v?(?P<version>\d+\.\d+\.\d+\S*)$`
+
+//VersionResolver finds the version of a finished build
+type VersionResolver interface {
+	Resolve(ctx context.Context, t *Tracker) (string, error)
+}
+
+//ArtifactVersion takes the version from the name of the first artifact
+//that matches Pattern. Checksum files published next to an artifact are
+//skipped
+type ArtifactVersion struct {
+	Pattern *regexp.Regexp
+}
+
+//Resolve implements VersionResolver
+func (v ArtifactVersion) Resolve(ctx context.Context, t *Tracker) (string, error) {
+	artifacts, err := t.GetArtifacts(ctx)
+	if err != nil {
+		return "", err
+	}
+	names := []string{}
+	for _, a := range artifacts {
+		if _, ok := checksums[strings.ToLower(path.Ext(a.Name))]; ok {
+			continue
+		}
+		names = append(names, path.Base(a.Name))
+	}
+	if version, ok := extractVersion(v.Pattern, names); ok {
+		return version, nil
+	}
+	return "", fmt.Errorf("Unable to determine version, no artifact of build %d matches %s", t.ID(), v.Pattern)
+}
+
+//NumberVersion uses the Teamcity build number. Pattern is optional
+type NumberVersion struct {
+	Pattern *regexp.Regexp
+}
+
+//Resolve implements VersionResolver
+func (v NumberVersion) Resolve(ctx context.Context, t *Tracker) (string, error) {
+	//builds tracked from a state file only know their id
+	if t.Build.Number == "" {
+		if err := t.GetBuild(ctx); err != nil {
+			return "", err
+		}
+	}
+	if version, ok := extractVersion(v.Pattern, []string{t.Build.Number}); ok {
+		return version, nil
+	}
+	return "", fmt.Errorf("Unable to determine version from build number %q of build %d", t.Build.Number, t.ID())
+}
+
+//PropertyVersion reads a resulting build property, ex a parameter set by
+//the build with ##teamcity[setParameter]. Pattern is optional
+type PropertyVersion struct {
+	Name    string
+	Pattern *regexp.Regexp
+}
+
+//Resolve implements VersionResolver
+func (v PropertyVersion) Resolve(ctx context.Context, t *Tracker) (string, error) {
+	var result struct {
+		Property []struct {
+			Name  string `json:"name"`
+			Value string `json:"value"`
+		} `json:"property"`
+	}
+	path := "/httpAuth/app/rest/builds/id:" + strconv.FormatInt(t.ID(), 10) + "/resulting-properties"
+	if err := t.builder.do(ctx, "GET", path, nil, &result); err != nil {
+		return "", err
+	}
+	for _, p := range result.Property {
+		if p.Name != v.Name {
+			continue
+		}
+		if version, ok := extractVersion(v.Pattern, []string{p.Value}); ok {
+			return version, nil
+		}
+		return "", fmt.Errorf("Unable to determine version from %s=%q of build %d", v.Name, p.Value, t.ID())
+	}
+	return "", fmt.Errorf("Build %d has no property %s to take the version from", t.ID(), v.Name)
+}
+
+//TagVersion takes the version from the VCS labels Teamcity applied to the
+//build or, failing that, from the branch when a tag was built
+type TagVersion struct {
+	Pattern *regexp.Regexp
+}
+
+//Resolve implements VersionResolver
+func (v TagVersion) Resolve(ctx context.Context, t *Tracker) (string, error) {
+	var result struct {
+		BranchName string `json:"branchName"`
+		VcsLabels  []struct {
+			Text   string `json:"text"`
+			Status string `json:"status"`
+		} `json:"vcsLabels"`
+	}
+	path := "/httpAuth/app/rest/builds/id:" + strconv.FormatInt(t.ID(), 10) +
+		"?fields=" + url.QueryEscape("branchName,vcsLabels(text,status)")
+	if err := t.builder.do(ctx, "GET", path, nil, &result); err != nil {
+		return "", err
+	}
+	tags := []string{}
+	for _, l := range result.VcsLabels {
+		if l.Status == "" || l.Status == "SUCCESSFUL_APPLY" {
+			tags = append(tags, l.Text)
+		}
+	}
+	tags = append(tags, result.BranchName)
+	if version, ok := extractVersion(v.Pattern, tags); ok {
+		return version, nil
+	}
+	return "", fmt.Errorf("Unable to determine version, no tag of build %d matches %s", t.ID(), v.Pattern)
+}
+
+//NewVersionResolver creates the resolver described by c. A blank source
+//reads the version from the artifact name
+func NewVersionResolver(c config.VersionConfig) (VersionResolver, error) {
+	pattern := c.Pattern
+	switch c.Source {
+	case "", VersionFromArtifact:
+		if pattern == "" {
+			pattern = DefaultVersionPattern
+		}
+	case VersionFromTag:
+		if pattern == "" {
+			pattern = defaultTagPattern
+		}
+	case VersionFromProperty:
+		if c.Property == "" {
+			return nil, errors.New("A property name is needed to read the version from a build property")
+		}
+	case VersionFromNumber:
+	default:
+		return nil, fmt.Errorf("Unknown version source %q, expected artifact, number, property or tag", c.Source)
+	}
+
+	var re *regexp.Regexp
+	if pattern != "" {
+		var err error
+		if re, err = regexp.Compile(pattern); err != nil {
+			return nil, fmt.Errorf("Invalid version pattern %q: %s", pattern, err)
+		}
+	}
+
+	switch c.Source {
+	case VersionFromNumber:
+		return NumberVersion{Pattern: re}, nil
+	case VersionFromProperty:
+		return PropertyVersion{Name: c.Property, Pattern: re}, nil
+	case VersionFromTag:
+		return TagVersion{Pattern: re}, nil
+	}
+	return ArtifactVersion{Pattern: re}, nil
+}
+
+//VersionResolvers picks the resolver for each build from the configured
+//version sources
+type VersionResolvers struct {
+	byName   map[string]VersionResolver
+	fallback VersionResolver
+}
+
+//NewVersionResolvers creates the resolvers for every configured entry so
+//a bad entry is reported before any builds are started
+func NewVersionResolvers(versions map[string]config.VersionConfig) (*VersionResolvers, error) {
+	r := &VersionResolvers{byName: map[string]VersionResolver{}}
+	for name, c := range versions {
+		resolver, err := NewVersionResolver(c)
+		if err != nil {
+			return nil, fmt.Errorf("versions %s: %s", name, err)
+		}
+		if name == "default" {
+			r.fallback = resolver
+		} else {
+			r.byName[name] = resolver
+		}
+	}
+	if r.fallback == nil {
+		r.fallback = ArtifactVersion{Pattern: regexp.MustCompile(DefaultVersionPattern)}
+	}
+	return r, nil
+}
+
+//For returns the resolver for a build. An entry for the build configuration
+//wins over one for the Octopus project
+func (r *VersionResolvers) For(bi BuildInfo, project string) VersionResolver {
+	if v, ok := r.byName[bi.BuildConfigID]; ok {
+		return v
+	}
+	if v, ok := r.byName[project]; ok {
+		return v
+	}
+	return r.fallback
+}
+
+//extractVersion returns the version pattern finds in the first value it
+//matches. Without a pattern the first non blank value is the version
+func extractVersion(pattern *regexp.Regexp, values []string) (string, bool) {
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+		if pattern == nil {
+			return value, true
+		}
+		m := pattern.FindStringSubmatch(value)
+		if m == nil {
+			continue
+		}
+		for i, name := range pattern.SubexpNames() {
+			if name == "version" {
+				return m[i], true
+			}
+		}
+		if len(m) > 1 {
+			return m[1], true
+		}
+		return m[0], true
+	}
+	return "", false
+}
@@ -0,0 +1,219 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mkobaly/devop/config"
+)
+
+//Defaults used for any setting left blank in the config file
+const (
+	DefaultRetries   = 3
+	DefaultBaseDelay = 500 * time.Millisecond
+	DefaultMaxDelay  = 30 * time.Second
+	DefaultBudget    = 100
+)
+
+//maxRetryAfter caps how long a Retry-After header can make us wait
+const maxRetryAfter = 2 * time.Minute
+
+//Transport is the http.RoundTripper shared by the Teamcity, Octopus and
+//Jira clients. Idempotent requests that fail with a network error, a 429
+//or a 5xx are retried with exponential backoff and jitter, waiting as long
+//as the server asks when it sends Retry-After. Requests to each host are
+//spaced out to RateLimit per second and Budget caps how many retries the
+//whole run may make so an unreachable server doesn't stall it forever
+type Transport struct {
+	Base      http.RoundTripper
+	Retries   int
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	RateLimit float64
+
+	mu     sync.Mutex
+	budget int
+	next   map[string]time.Time
+}
+
+//New creates a Transport from the http section of the config file
+func New(c config.HTTPConfig) *Transport {
+	t := &Transport{
+		Base:      http.DefaultTransport,
+		Retries:   c.Retries,
+		BaseDelay: c.BaseDelay,
+		MaxDelay:  c.MaxDelay,
+		RateLimit: c.RateLimit,
+		budget:    c.Budget,
+		next:      map[string]time.Time{},
+	}
+	if t.Retries == 0 {
+		t.Retries = DefaultRetries
+	}
+	if t.BaseDelay <= 0 {
+		t.BaseDelay = DefaultBaseDelay
+	}
+	if t.MaxDelay <= 0 {
+		t.MaxDelay = DefaultMaxDelay
+	}
+	if t.budget == 0 {
+		t.budget = DefaultBudget
+	}
+	return t
+}
+
+//Client is the http client every api client uses. Configure replaces its
+//transport with one built from the config file
+var Client = &http.Client{Transport: New(config.HTTPConfig{})}
+
+//Configure sets up the shared client from the http section of the config file
+func Configure(c config.HTTPConfig) {
+	Client.Transport = New(c)
+}
+
+//RoundTrip implements http.RoundTripper
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !idempotent(req.Method) || t.Retries < 0 {
+		if err := t.wait(req); err != nil {
+			return nil, err
+		}
+		return t.Base.RoundTrip(req)
+	}
+
+	//the body has to be replayed on each attempt
+	var body []byte
+	if req.Body != nil {
+		var err error
+		if body, err = ioutil.ReadAll(req.Body); err != nil {
+			return nil, err
+		}
+		req.Body.Close()
+	}
+
+	for attempt := 1; ; attempt++ {
+		r := req.WithContext(req.Context())
+		if body != nil {
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+		if err := t.wait(r); err != nil {
+			return nil, err
+		}
+		resp, err := t.Base.RoundTrip(r)
+		if req.Context().Err() != nil || !retryable(resp, err) || attempt > t.Retries || !t.spend() {
+			return resp, err
+		}
+
+		delay := t.backoff(attempt)
+		if resp != nil {
+			if after, ok := retryAfter(resp); ok {
+				delay = after
+			}
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		if err := sleep(req.Context(), delay); err != nil {
+			return nil, err
+		}
+	}
+}
+
+//wait blocks until the host of req may be sent another request
+func (t *Transport) wait(req *http.Request) error {
+	if t.RateLimit <= 0 {
+		return nil
+	}
+	interval := time.Duration(float64(time.Second) / t.RateLimit)
+
+	t.mu.Lock()
+	now := time.Now()
+	at := t.next[req.URL.Host]
+	if at.Before(now) {
+		at = now
+	}
+	t.next[req.URL.Host] = at.Add(interval)
+	t.mu.Unlock()
+
+	return sleep(req.Context(), at.Sub(now))
+}
+
+//spend takes one retry from the budget and returns false once it is used up
+func (t *Transport) spend() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.budget <= 0 {
+		return false
+	}
+	t.budget--
+	return true
+}
+
+//backoff returns how long to wait before retry number attempt (starting
+//at 1). The delay doubles each attempt up to MaxDelay and a random jitter
+//of up to half the delay is taken off so clients don't retry in step
+func (t *Transport) backoff(attempt int) time.Duration {
+	d := t.BaseDelay
+	for i := 1; i < attempt && d < t.MaxDelay; i++ {
+		d *= 2
+	}
+	if d > t.MaxDelay {
+		d = t.MaxDelay
+	}
+	return d - time.Duration(rand.Int63n(int64(d)/2+1))
+}
+
+//idempotent returns true for requests that are safe to send twice
+func idempotent(method string) bool {
+	return method == "GET" || method == "HEAD" || method == "OPTIONS"
+}
+
+//retryable returns true if the request failed in a way that may go away
+func retryable(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+}
+
+//retryAfter reads the Retry-After header which is either a number of
+//seconds or a date
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	v := resp.Header.Get("Retry-After")
+	if v == "" {
+		return 0, false
+	}
+	var d time.Duration
+	if secs, err := strconv.Atoi(v); err == nil {
+		d = time.Duration(secs) * time.Second
+	} else if at, err := http.ParseTime(v); err == nil {
+		d = time.Until(at)
+	} else {
+		return 0, false
+	}
+	if d < 0 {
+		d = 0
+	}
+	if d > maxRetryAfter {
+		d = maxRetryAfter
+	}
+	return d, true
+}
+
+//sleep waits for d or until ctx is cancelled
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(d):
+		return nil
+	}
+}